@@ -17,10 +17,16 @@ limitations under the License.
 package v1beta1
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
 
 	"github.com/nmaupu/vault-secret/pkg/k8sutils"
 	nmvault "github.com/nmaupu/vault-secret/pkg/vault"
+	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
@@ -36,42 +42,452 @@ func (a BySecretKey) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
 // Less checks if a given SecretKey object is lexicographically inferior to another SecretKey object
 func (a BySecretKey) Less(i, j int) bool { return a[i].SecretKey < a[j].SecretKey }
 
+// WithDefaults returns the configuration completed with the given defaults for the fields not set
+// Auth and AuthChain are taken as a whole from the defaults if no auth method is set and the default vault server is used
+func (c VaultSecretSpecConfig) WithDefaults(defaults *VaultSecretSpecConfig) VaultSecretSpecConfig {
+	if defaults == nil {
+		return c
+	}
+
+	config := *c.DeepCopy()
+	// TLS defaults only apply to the default vault server
+	defaultServer := !c.HasAddress()
+	if defaultServer {
+		config.Addr = defaults.Addr
+		config.Addrs = append([]string(nil), defaults.Addrs...)
+	}
+	if config.Namespace == "" {
+		config.Namespace = defaults.Namespace
+	}
+	if config.Insecure == nil && defaultServer && defaults.Insecure != nil {
+		insecure := *defaults.Insecure
+		config.Insecure = &insecure
+	}
+	if config.CABundle == "" && config.CASecretRef == nil && config.CAConfigMapRef == nil && defaultServer {
+		config.CABundle = defaults.CABundle
+		if defaults.CASecretRef != nil {
+			config.CASecretRef = defaults.CASecretRef.DeepCopy()
+		}
+		if defaults.CAConfigMapRef != nil {
+			config.CAConfigMapRef = defaults.CAConfigMapRef.DeepCopy()
+		}
+	}
+	if config.TLSServerName == "" && defaultServer {
+		config.TLSServerName = defaults.TLSServerName
+	}
+	if config.ClientCertSecretName == "" && defaultServer {
+		config.ClientCertSecretName = defaults.ClientCertSecretName
+	}
+	if config.Consistency == "" {
+		config.Consistency = defaults.Consistency
+	}
+	// The operator's credentials are only sent to the default vault server
+	if reflect.DeepEqual(config.Auth, VaultSecretSpecConfigAuth{}) && len(config.AuthChain) == 0 && defaultServer {
+		defaults.Auth.DeepCopyInto(&config.Auth)
+		for _, auth := range defaults.AuthChain {
+			config.AuthChain = append(config.AuthChain, *auth.DeepCopy())
+		}
+	}
+
+	return config
+}
+
+// WithIdentityPolicy returns the configuration adapted to the operator's identity policy
+// In the operator and mapping modes, the service accounts are shared by several namespaces: their tokens are only
+// sent to the default vault server and are requested for the api server's audiences, the ones of the configuration are ignored
+func (c VaultSecretSpecConfig) WithIdentityPolicy(p *k8sutils.IdentityPolicy) (VaultSecretSpecConfig, error) {
+	if !p.SharedIdentity() {
+		return c, nil
+	}
+
+	config := *c.DeepCopy()
+	auths := []*VaultSecretSpecConfigAuth{&config.Auth}
+	for i := range config.AuthChain {
+		auths = append(auths, &config.AuthChain[i])
+	}
+	for _, auth := range auths {
+		if !auth.usesServiceAccount() {
+			continue
+		}
+		if c.HasAddress() {
+			return c, fmt.Errorf("Service account authentication is only allowed with the default vault server in the %s identity mode", p.Mode)
+		}
+		auth.Kubernetes.Audiences = nil
+		auth.JWT.Audiences = nil
+	}
+
+	return config, nil
+}
+
+// HasAddress checks whether a vault address is set
+func (c VaultSecretSpecConfig) HasAddress() bool {
+	return c.Addr != "" || len(c.Addrs) > 0
+}
+
+// UsesInlineToken checks whether a token is set directly in the configuration, in auth or in any entry of authChain
+func (c VaultSecretSpecConfig) UsesInlineToken() bool {
+	if c.Auth.Token != "" {
+		return true
+	}
+	for _, auth := range c.AuthChain {
+		if auth.Token != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOperatorFiles returns an error if an auth method reads a file of the operator's filesystem
+// Such auth methods are only allowed in the operator's default configuration, any custom resource could
+// otherwise send the operator's files (e.g. its own service account token) to a vault server it controls
+// AWS without static credentials signs its login request with the operator's web identity, it could be replayed the same way
+func (c VaultSecretSpecConfig) CheckOperatorFiles() error {
+	if option := c.operatorFileOption(); option != "" {
+		return fmt.Errorf("%s is only allowed in the operator's default configuration", option)
+	}
+
+	return nil
+}
+
+// operatorFileOption returns the first auth option reading a file of the operator's filesystem, empty if none
+func (c VaultSecretSpecConfig) operatorFileOption() string {
+	auths := append([]VaultSecretSpecConfigAuth{c.Auth}, c.AuthChain...)
+	for _, auth := range auths {
+		if auth.TokenFile != "" {
+			return "tokenFile"
+		}
+		if auth.JWT.File != "" {
+			return "jwt.file"
+		}
+		if auth.AWS.Role != "" && auth.AWS.CredentialsSecretName == "" {
+			return "aws without credentialsSecretName"
+		}
+	}
+
+	return ""
+}
+
+// GetVaultConfig returns the configuration of the connection to vault, reading the referenced CA bundles and client certificate
+// CA bundles from all the configured sources are trusted
+func (cr *VaultSecret) GetVaultConfig(c client.Client) (*nmvault.Config, error) {
+	config := nmvault.NewConfig(cr.Spec.Config.Addr)
+	if len(cr.Spec.Config.Addrs) > 0 {
+		config.Address = cr.Spec.Config.Addrs[0]
+		config.Addresses = cr.Spec.Config.Addrs
+	}
+	config.Namespace = cr.Spec.Config.Namespace
+	config.Insecure = cr.Spec.Config.Insecure != nil && *cr.Spec.Config.Insecure
+	config.TLSServerName = cr.Spec.Config.TLSServerName
+	config.Consistency = nmvault.ConsistencyMode(cr.Spec.Config.Consistency)
+
+	var caBundles [][]byte
+	if cr.Spec.Config.CABundle != "" {
+		caBundles = append(caBundles, []byte(cr.Spec.Config.CABundle))
+	}
+	if ref := cr.Spec.Config.CASecretRef; ref != nil {
+		val, err := k8sutils.GetSecretValue(c, cr.Namespace, ref.Name, ref.Key)
+		if err != nil {
+			return nil, err
+		}
+		caBundles = append(caBundles, val)
+	}
+	if ref := cr.Spec.Config.CAConfigMapRef; ref != nil {
+		val, err := k8sutils.GetConfigMapValue(c, cr.Namespace, ref.Name, ref.Key)
+		if err != nil {
+			return nil, err
+		}
+		caBundles = append(caBundles, val)
+	}
+	if len(caBundles) > 0 {
+		config.CACert = bytes.Join(caBundles, []byte("\n"))
+	}
+
+	if cr.Spec.Config.ClientCertSecretName != "" {
+		cert, key, err := k8sutils.GetTLSKeyPair(c, cr.Namespace, cr.Spec.Config.ClientCertSecretName)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCert = cert
+		config.ClientKey = key
+	}
+
+	return config, nil
+}
+
 // GetVaultAuthProvider implem from custom resource object
-func (cr *VaultSecret) GetVaultAuthProvider(c client.Client) (nmvault.AuthProvider, error) {
+// If an auth chain is configured, a provider trying each auth method in order is returned
+// The identity policy selects the service account used by the Kubernetes auth method, nil to use the custom resource's namespace
+func (cr *VaultSecret) GetVaultAuthProvider(c client.Client, cs kubernetes.Interface, identityPolicy *k8sutils.IdentityPolicy) (nmvault.AuthProvider, error) {
+	if len(cr.Spec.Config.AuthChain) == 0 {
+		return cr.getAuthProvider(cr.Spec.Config.Auth, c, cs, identityPolicy)
+	}
+
+	var providers []nmvault.AuthProvider
+	var errs []string
+	for i, auth := range cr.Spec.Config.AuthChain {
+		provider, err := cr.getAuthProvider(auth, c, cs, identityPolicy)
+		if err != nil {
+			// Trying the next auth methods anyway
+			errs = append(errs, fmt.Sprintf("authChain[%d]: %v", i, err))
+			continue
+		}
+		providers = append(providers, provider)
+	}
+
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("Cannot use any auth method of the auth chain, err=[%s]", strings.Join(errs, "; "))
+	}
+
+	return nmvault.NewChainProvider(providers...), nil
+}
+
+// getAuthProvider returns the provider of the given auth method
+func (cr *VaultSecret) getAuthProvider(auth VaultSecretSpecConfigAuth, c client.Client, cs kubernetes.Interface, identityPolicy *k8sutils.IdentityPolicy) (nmvault.AuthProvider, error) {
 	// Checking order:
+	//   - Token from a secret
 	//   - Token
+	//   - Token file
 	//   - AppRole
 	//   - Kubernetes Auth Method
-	if cr.Spec.Config.Auth.Token != "" {
-		return nmvault.NewTokenProvider(cr.Spec.Config.Auth.Token), nil
-	} else if cr.Spec.Config.Auth.AppRole.RoleID != "" {
+	//   - JWT/OIDC Auth Method
+	//   - TLS Certificates Auth Method
+	//   - Userpass Auth Method
+	//   - LDAP Auth Method
+	//   - AWS Auth Method
+	if auth.TokenSecretRef != nil {
+		tok, err := k8sutils.GetSecretValue(c, cr.Namespace, auth.TokenSecretRef.Name, auth.TokenSecretRef.Key)
+		if err != nil {
+			return nil, err
+		}
+		return nmvault.NewTokenProvider(strings.TrimSpace(string(tok))), nil
+	} else if auth.Token != "" {
+		return nmvault.NewTokenProvider(auth.Token), nil
+	} else if auth.TokenFile != "" {
+		return nmvault.NewTokenFileProvider(auth.TokenFile), nil
+	} else if auth.AppRole.RoleID != "" {
 		appRoleName := "approle" // Default approle name value
-		if cr.Spec.Config.Auth.AppRole.Name != "" {
-			appRoleName = cr.Spec.Config.Auth.AppRole.Name
+		if auth.AppRole.Name != "" {
+			appRoleName = auth.AppRole.Name
 		}
-		return nmvault.NewAppRoleProvider(
+		provider := nmvault.NewAppRoleProvider(
 			appRoleName,
-			cr.Spec.Config.Auth.AppRole.RoleID,
-			cr.Spec.Config.Auth.AppRole.SecretID,
+			auth.AppRole.RoleID,
+			auth.AppRole.SecretID,
+		)
+
+		if ref := auth.AppRole.SecretIDSecretRef; ref != nil {
+			val, err := k8sutils.GetSecretValue(c, cr.Namespace, ref.Name, ref.Key)
+			if err != nil {
+				return nil, err
+			}
+
+			if auth.AppRole.SecretIDWrapped {
+				provider.SetWrappedSecretID(strings.TrimSpace(string(val)))
+			} else {
+				provider.SecretID = strings.TrimSpace(string(val))
+			}
+		}
+
+		return provider, nil
+	} else if auth.Kubernetes.Role != "" {
+		// Retrieving token for the serviceAccount selected by the operator's identity policy
+		// The token is only created when a new vault login is needed
+		k8sAuth := auth.Kubernetes
+		sa, err := identityPolicy.ServiceAccount(cr.Namespace, k8sAuth.ServiceAccount)
+		if err != nil {
+			return nil, err
+		}
+
+		provider := nmvault.NewKubernetesProvider(
+			auth.Kubernetes.Role,
+			auth.Kubernetes.Cluster,
+			"",
+		)
+		provider.SetJWTSource(sa.Subject(), func() (string, error) {
+			if k8sAuth.UseLegacyTokenSecret {
+				return k8sutils.GetTokenFromSA(c, sa.Namespace, sa.Name)
+			}
+			return k8sutils.RequestTokenForSA(cs, sa.Namespace, sa.Name, k8sAuth.Audiences, k8sAuth.ExpirationSeconds)
+		})
+		return provider, nil
+	} else if auth.JWT.Role != "" {
+		jwtAuth := auth.JWT
+		jwtName := "jwt" // Default jwt auth method path
+		if jwtAuth.Name != "" {
+			jwtName = jwtAuth.Name
+		}
+
+		var tok string
+		switch {
+		case jwtAuth.ServiceAccount != "":
+			// The service account is selected by the operator's identity policy, as with the Kubernetes auth method
+			sa, err := identityPolicy.ServiceAccount(cr.Namespace, jwtAuth.ServiceAccount)
+			if err != nil {
+				return nil, err
+			}
+			provider := nmvault.NewJWTProvider(jwtName, jwtAuth.Role, "")
+			provider.SetJWTSource(sa.Subject(), func() (string, error) {
+				return k8sutils.RequestTokenForSA(cs, sa.Namespace, sa.Name, jwtAuth.Audiences, jwtAuth.ExpirationSeconds)
+			})
+			return provider, nil
+		case jwtAuth.SecretRef != nil:
+			val, err := k8sutils.GetSecretValue(c, cr.Namespace, jwtAuth.SecretRef.Name, jwtAuth.SecretRef.Key)
+			if err != nil {
+				return nil, err
+			}
+			tok = string(val)
+		case jwtAuth.File != "":
+			val, err := ioutil.ReadFile(jwtAuth.File)
+			if err != nil {
+				return nil, err
+			}
+			tok = string(val)
+		default:
+			return nil, errors.New("No JWT source configured, please choose between serviceAccount, secretRef or file")
+		}
+
+		return nmvault.NewJWTProvider(
+			jwtName,
+			jwtAuth.Role,
+			strings.TrimSpace(tok),
 		), nil
-	} else if cr.Spec.Config.Auth.Kubernetes.Role != "" {
-		// Retrieving token from the serviceAccount configured
-		saName := cr.Spec.Config.Auth.Kubernetes.ServiceAccount
-		if saName == "" {
-			saName = "default"
+	} else if auth.Cert.SecretName != "" {
+		certName := "cert" // Default cert auth method path
+		if auth.Cert.Name != "" {
+			certName = auth.Cert.Name
 		}
 
-		tok, err := k8sutils.GetTokenFromSA(c, cr.Namespace, saName)
+		// Certificate is read on each call so that a rotated secret is taken into account
+		cert, key, err := k8sutils.GetTLSKeyPair(c, cr.Namespace, auth.Cert.SecretName)
 		if err != nil {
 			return nil, err
 		}
 
-		return nmvault.NewKubernetesProvider(
-			cr.Spec.Config.Auth.Kubernetes.Role,
-			cr.Spec.Config.Auth.Kubernetes.Cluster,
-			tok,
+		return nmvault.NewCertProvider(
+			certName,
+			auth.Cert.Role,
+			cert,
+			key,
 		), nil
+	} else if auth.UserPass.SecretName != "" {
+		userPassAuth := auth.UserPass
+		userPassName := "userpass" // Default userpass auth method path
+		if userPassAuth.Name != "" {
+			userPassName = userPassAuth.Name
+		}
+
+		username, password, err := k8sutils.GetBasicAuthCredentials(c, cr.Namespace, userPassAuth.SecretName, userPassAuth.UsernameKey, userPassAuth.PasswordKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return nmvault.NewUserPassProvider(userPassName, username, password), nil
+	} else if auth.LDAP.SecretName != "" {
+		ldapAuth := auth.LDAP
+		ldapName := "ldap" // Default ldap auth method path
+		if ldapAuth.Name != "" {
+			ldapName = ldapAuth.Name
+		}
+
+		username, password, err := k8sutils.GetBasicAuthCredentials(c, cr.Namespace, ldapAuth.SecretName, ldapAuth.UsernameKey, ldapAuth.PasswordKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return nmvault.NewLDAPProvider(ldapName, username, password), nil
+	} else if auth.AWS.Role != "" {
+		awsAuth := auth.AWS
+		awsName := "aws" // Default aws auth method path
+		if awsAuth.Name != "" {
+			awsName = awsAuth.Name
+		}
+
+		provider := nmvault.NewAWSIAMProvider(awsName, awsAuth.Role, awsAuth.STSRegion, awsAuth.STSEndpoint, awsAuth.IAMServerIDHeaderValue)
+		if awsAuth.CredentialsSecretName != "" {
+			accessKeyID, err := k8sutils.GetSecretValue(c, cr.Namespace, awsAuth.CredentialsSecretName, "AWS_ACCESS_KEY_ID")
+			if err != nil {
+				return nil, err
+			}
+			secretAccessKey, err := k8sutils.GetSecretValue(c, cr.Namespace, awsAuth.CredentialsSecretName, "AWS_SECRET_ACCESS_KEY")
+			if err != nil {
+				return nil, err
+			}
+			// Session token is optional
+			sessionToken, err := k8sutils.GetSecretValue(c, cr.Namespace, awsAuth.CredentialsSecretName, "AWS_SESSION_TOKEN")
+			if err != nil && k8sutils.ErrorReason(err) != k8sutils.ReasonSecretKeyNotFound {
+				return nil, err
+			}
+
+			provider.SetStaticCredentials(string(accessKeyID), string(secretAccessKey), string(sessionToken))
+		}
+
+		return provider, nil
+	}
+
+	return nil, errors.New("Cannot find a way to authenticate, please choose between Token, TokenFile, AppRole, Kubernetes, JWT, Cert, UserPass, LDAP or AWS")
+}
+
+// GetReferencedSecrets returns the names of the secrets the custom resource reads its configuration from
+func (cr *VaultSecret) GetReferencedSecrets() []string {
+	secrets := cr.Spec.Config.Auth.getReferencedSecrets()
+	if cr.Spec.Config.CASecretRef != nil {
+		secrets = append(secrets, cr.Spec.Config.CASecretRef.Name)
+	}
+	if cr.Spec.Config.ClientCertSecretName != "" {
+		secrets = append(secrets, cr.Spec.Config.ClientCertSecretName)
+	}
+	for _, auth := range cr.Spec.Config.AuthChain {
+		secrets = append(secrets, auth.getReferencedSecrets()...)
+	}
+
+	return secrets
+}
+
+// GetReferencedConfigMaps returns the names of the config maps the custom resource reads its configuration from
+func (cr *VaultSecret) GetReferencedConfigMaps() []string {
+	var configMaps []string
+	if cr.Spec.Config.CAConfigMapRef != nil {
+		configMaps = append(configMaps, cr.Spec.Config.CAConfigMapRef.Name)
+	}
+	for _, s := range cr.Spec.Secrets {
+		if s.Transit != nil && s.Transit.CiphertextConfigMapRef != nil {
+			configMaps = append(configMaps, s.Transit.CiphertextConfigMapRef.Name)
+		}
+	}
+
+	return configMaps
+}
+
+// usesServiceAccount checks whether an auth method authenticates with a service account's token
+func (auth VaultSecretSpecConfigAuth) usesServiceAccount() bool {
+	return auth.Kubernetes.Role != "" || (auth.JWT.Role != "" && auth.JWT.ServiceAccount != "")
+}
+
+// getReferencedSecrets returns the names of the secrets an auth method reads its configuration from
+func (auth VaultSecretSpecConfigAuth) getReferencedSecrets() []string {
+	var secrets []string
+
+	if auth.TokenSecretRef != nil {
+		secrets = append(secrets, auth.TokenSecretRef.Name)
+	}
+	if auth.AppRole.SecretIDSecretRef != nil {
+		secrets = append(secrets, auth.AppRole.SecretIDSecretRef.Name)
+	}
+	if auth.JWT.SecretRef != nil {
+		secrets = append(secrets, auth.JWT.SecretRef.Name)
+	}
+	if auth.Cert.SecretName != "" {
+		secrets = append(secrets, auth.Cert.SecretName)
+	}
+	if auth.UserPass.SecretName != "" {
+		secrets = append(secrets, auth.UserPass.SecretName)
+	}
+	if auth.LDAP.SecretName != "" {
+		secrets = append(secrets, auth.LDAP.SecretName)
+	}
+	if auth.AWS.CredentialsSecretName != "" {
+		secrets = append(secrets, auth.AWS.CredentialsSecretName)
 	}
 
-	return nil, errors.New("Cannot find a way to authenticate, please choose between Token, AppRole or Kubernetes")
+	return secrets
 }
@@ -0,0 +1,217 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/nmaupu/vault-secret/pkg/k8sutils"
+	nmvault "github.com/nmaupu/vault-secret/pkg/vault"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestWithDefaultsAuth(t *testing.T) {
+	defaults := &VaultSecretSpecConfig{
+		Addr: "https://vault.example.com",
+		Auth: VaultSecretSpecConfigAuth{AppRole: AppRoleAuthType{RoleID: "operator", SecretID: "s3cr3t"}},
+	}
+	crAuth := VaultSecretSpecConfigAuth{Kubernetes: KubernetesAuthType{Role: "app"}}
+
+	tests := []struct {
+		name     string
+		config   VaultSecretSpecConfig
+		wantAddr string
+		wantAuth VaultSecretSpecConfigAuth
+	}{
+		{name: "default server, default auth", config: VaultSecretSpecConfig{},
+			wantAddr: "https://vault.example.com", wantAuth: defaults.Auth},
+		{name: "default server, own auth", config: VaultSecretSpecConfig{Auth: crAuth},
+			wantAddr: "https://vault.example.com", wantAuth: crAuth},
+		{name: "own addr, no default auth", config: VaultSecretSpecConfig{Addr: "https://other.example.com"},
+			wantAddr: "https://other.example.com"},
+		{name: "own addrs, no default auth", config: VaultSecretSpecConfig{Addrs: []string{"https://other.example.com"}}},
+		{name: "own addr, own auth", config: VaultSecretSpecConfig{Addr: "https://other.example.com", Auth: crAuth},
+			wantAddr: "https://other.example.com", wantAuth: crAuth},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.config.WithDefaults(defaults)
+			if got.Addr != tt.wantAddr {
+				t.Errorf("Addr=%s, want %s", got.Addr, tt.wantAddr)
+			}
+			if !reflect.DeepEqual(got.Auth, tt.wantAuth) {
+				t.Errorf("Auth=%+v, want %+v", got.Auth, tt.wantAuth)
+			}
+		})
+	}
+}
+
+func TestWithIdentityPolicy(t *testing.T) {
+	k8sAuth := VaultSecretSpecConfigAuth{Kubernetes: KubernetesAuthType{Role: "app", Audiences: []string{"attacker"}}}
+	jwtAuth := VaultSecretSpecConfigAuth{JWT: JWTAuthType{Role: "app", ServiceAccount: "reader", Audiences: []string{"attacker"}}}
+	appRoleAuth := VaultSecretSpecConfigAuth{AppRole: AppRoleAuthType{RoleID: "app"}}
+	operatorPolicy := &k8sutils.IdentityPolicy{Mode: k8sutils.IdentityModeOperator}
+	mappingPolicy := &k8sutils.IdentityPolicy{Mode: k8sutils.IdentityModeMapping}
+	namespacePolicy := &k8sutils.IdentityPolicy{Mode: k8sutils.IdentityModeNamespace}
+
+	tests := []struct {
+		name          string
+		config        VaultSecretSpecConfig
+		policy        *k8sutils.IdentityPolicy
+		wantErr       bool
+		wantAudiences bool
+	}{
+		{name: "namespace mode, own addr", policy: namespacePolicy, wantAudiences: true,
+			config: VaultSecretSpecConfig{Addr: "https://other.example.com", Auth: k8sAuth}},
+		{name: "no policy, own addr", policy: nil, wantAudiences: true,
+			config: VaultSecretSpecConfig{Addr: "https://other.example.com", Auth: k8sAuth}},
+		{name: "operator mode, default server", policy: operatorPolicy,
+			config: VaultSecretSpecConfig{Auth: k8sAuth}},
+		{name: "operator mode, own addr", policy: operatorPolicy, wantErr: true,
+			config: VaultSecretSpecConfig{Addr: "https://other.example.com", Auth: k8sAuth}},
+		{name: "mapping mode, own addrs", policy: mappingPolicy, wantErr: true,
+			config: VaultSecretSpecConfig{Addrs: []string{"https://other.example.com"}, Auth: k8sAuth}},
+		{name: "mapping mode, jwt service account in auth chain", policy: mappingPolicy, wantErr: true,
+			config: VaultSecretSpecConfig{Addr: "https://other.example.com", AuthChain: []VaultSecretSpecConfigAuth{appRoleAuth, jwtAuth}}},
+		{name: "mapping mode, jwt service account, default server", policy: mappingPolicy,
+			config: VaultSecretSpecConfig{AuthChain: []VaultSecretSpecConfigAuth{jwtAuth}}},
+		{name: "operator mode, own addr without service account", policy: operatorPolicy,
+			config: VaultSecretSpecConfig{Addr: "https://other.example.com", Auth: appRoleAuth}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.config.WithIdentityPolicy(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("WithIdentityPolicy() err=%v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			for _, auth := range append([]VaultSecretSpecConfigAuth{got.Auth}, got.AuthChain...) {
+				if !auth.usesServiceAccount() {
+					continue
+				}
+				hasAudiences := len(auth.Kubernetes.Audiences) > 0 || len(auth.JWT.Audiences) > 0
+				if hasAudiences != tt.wantAudiences {
+					t.Errorf("audiences kept=%t, want %t", hasAudiences, tt.wantAudiences)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckOperatorFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    VaultSecretSpecConfigAuth
+		wantErr bool
+	}{
+		{name: "token secret", auth: VaultSecretSpecConfigAuth{TokenSecretRef: &SecretKeyRef{Name: "token", Key: "token"}}},
+		{name: "token file", auth: VaultSecretSpecConfigAuth{TokenFile: "/vault/token"}, wantErr: true},
+		{name: "jwt secret", auth: VaultSecretSpecConfigAuth{JWT: JWTAuthType{Role: "app", SecretRef: &SecretKeyRef{Name: "jwt", Key: "jwt"}}}},
+		{name: "jwt file", auth: VaultSecretSpecConfigAuth{JWT: JWTAuthType{Role: "app", File: "/var/run/token"}}, wantErr: true},
+		{name: "aws static credentials", auth: VaultSecretSpecConfigAuth{AWS: AWSAuthType{Role: "app", CredentialsSecretName: "aws"}}},
+		{name: "aws operator credentials", auth: VaultSecretSpecConfigAuth{AWS: AWSAuthType{Role: "app"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, config := range []VaultSecretSpecConfig{{Auth: tt.auth}, {AuthChain: []VaultSecretSpecConfigAuth{{Token: "s.token"}, tt.auth}}} {
+				if err := config.CheckOperatorFiles(); (err != nil) != tt.wantErr {
+					t.Errorf("CheckOperatorFiles() err=%v, wantErr %t", err, tt.wantErr)
+				}
+			}
+		})
+	}
+}
+
+func TestGetVaultAuthProviderServiceAccountToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		auth      VaultSecretSpecConfigAuth
+		loginPath string
+	}{
+		{name: "kubernetes", auth: VaultSecretSpecConfigAuth{Kubernetes: KubernetesAuthType{Role: "app", Cluster: "kubernetes"}},
+			loginPath: "/v1/auth/kubernetes/login"},
+		{name: "jwt", auth: VaultSecretSpecConfigAuth{JWT: JWTAuthType{Role: "app", ServiceAccount: "reader"}},
+			loginPath: "/v1/auth/jwt/login"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := fake.NewSimpleClientset()
+			tokenRequests := 0
+			cs.PrependReactor("create", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				tokenRequests++
+				return true, &authenticationv1.TokenRequest{Status: authenticationv1.TokenRequestStatus{Token: "sa-token"}}, nil
+			})
+
+			var loginJWT interface{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != tt.loginPath {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				var body map[string]interface{}
+				json.NewDecoder(req.Body).Decode(&body)
+				loginJWT = body["jwt"]
+				json.NewEncoder(w).Encode(map[string]interface{}{"auth": map[string]interface{}{"client_token": "vault-token"}})
+			}))
+			defer server.Close()
+
+			cr := &VaultSecret{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "cr"},
+				Spec:       VaultSecretSpec{Config: VaultSecretSpecConfig{Auth: tt.auth}},
+			}
+			p, err := cr.GetVaultAuthProvider(nil, cs, nil)
+			if err != nil {
+				t.Fatalf("GetVaultAuthProvider() err=%v", err)
+			}
+			if tokenRequests != 0 {
+				t.Errorf("token requests=%d before login, want 0", tokenRequests)
+			}
+			if p.Identity() == "" {
+				t.Errorf("Identity() is empty")
+			}
+
+			vclient, err := p.Login(nmvault.NewConfig(server.URL))
+			if err != nil {
+				t.Fatalf("Login() err=%v", err)
+			}
+			if tokenRequests != 1 {
+				t.Errorf("token requests=%d after login, want 1", tokenRequests)
+			}
+			if loginJWT != "sa-token" {
+				t.Errorf("login jwt=%v, want sa-token", loginJWT)
+			}
+			if vclient.Token() != "vault-token" {
+				t.Errorf("Token()=%s, want vault-token", vclient.Token())
+			}
+		})
+	}
+}
@@ -24,29 +24,106 @@ import (
 // VaultSecretSpec defines the desired state of VaultSecret
 // +k8s:openapi-gen=true
 type VaultSecretSpec struct {
-	Config VaultSecretSpecConfig `json:"config,required"`
+	// Config of the vault connection, the operator's default configuration is used for fields not provided
+	// +optional
+	Config VaultSecretSpecConfig `json:"config,omitempty"`
 	// +listType=set
-	Secrets           []VaultSecretSpecSecret `json:"secrets,required"`
-	SecretName        string                  `json:"secretName,omitempty"`
-	SecretType        corev1.SecretType       `json:"secretType,omitempty"`
-	SecretLabels      map[string]string       `json:"secretLabels,omitempty"`
-	SecretAnnotations map[string]string       `json:"secretAnnotations,omitempty"`
-	SyncPeriod        metav1.Duration         `json:"syncPeriod,omitempty"`
+	Secrets []VaultSecretSpecSecret `json:"secrets,omitempty"`
+	// PKI issues a certificate from a PKI secrets engine into the tls.crt, tls.key and ca.crt keys of the secret
+	PKI               *VaultSecretSpecPKI `json:"pki,omitempty"`
+	SecretName        string              `json:"secretName,omitempty"`
+	SecretType        corev1.SecretType   `json:"secretType,omitempty"`
+	SecretLabels      map[string]string   `json:"secretLabels,omitempty"`
+	SecretAnnotations map[string]string   `json:"secretAnnotations,omitempty"`
+	SyncPeriod        metav1.Duration     `json:"syncPeriod,omitempty"`
+}
+
+// VaultSecretSpecPKI is a certificate to issue from a PKI secrets engine
+type VaultSecretSpecPKI struct {
+	// Mount is the path of the PKI secrets engine, defaults to pki
+	Mount string `json:"mount,omitempty"`
+	// Role is the name of the role to issue the certificate from
+	Role string `json:"role"`
+	// CommonName is the common name of the certificate
+	CommonName string `json:"commonName"`
+	// AltNames are the DNS names and email addresses subject alternative names of the certificate
+	AltNames []string `json:"altNames,omitempty"`
+	// IPSANs are the IP addresses subject alternative names of the certificate
+	IPSANs []string `json:"ipSans,omitempty"`
+	// URISANs are the URIs subject alternative names of the certificate
+	URISANs []string `json:"uriSans,omitempty"`
+	// TTL is the requested lifetime of the certificate, defaults to the role's TTL
+	TTL metav1.Duration `json:"ttl,omitempty"`
+	// RenewAfterPercent is the percentage of the certificate's lifetime after which it is issued again, defaults to 67
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=99
+	RenewAfterPercent int `json:"renewAfterPercent,omitempty"`
+	// Mode is issue (default) to let vault generate the private key, or sign to generate the private key
+	// in the operator and only send a CSR to vault, the private key never leaving the cluster
+	// +kubebuilder:validation:Enum=issue;sign
+	Mode string `json:"mode,omitempty"`
+	// PrivateKey configures the private key generated in sign mode
+	PrivateKey PKIPrivateKey `json:"privateKey,omitempty"`
+}
+
+// PKIPrivateKey is the configuration of a private key generated by the operator
+type PKIPrivateKey struct {
+	// Algorithm is the algorithm of the key, defaults to rsa
+	// +kubebuilder:validation:Enum=rsa;ecdsa;ed25519
+	Algorithm string `json:"algorithm,omitempty"`
+	// Size is the size of the key in bits: 2048 (default), 3072 or 4096 for rsa, 256 (default), 384 or 521 for ecdsa, ignored for ed25519
+	Size int `json:"size,omitempty"`
+	// RotationPolicy is always (default) to generate a new key on renewal, or never to reuse the current one
+	// +kubebuilder:validation:Enum=always;never
+	RotationPolicy string `json:"rotationPolicy,omitempty"`
 }
 
 // VaultSecretSpecConfig Configuration part of a vault-secret object
 type VaultSecretSpecConfig struct {
-	Addr      string                    `json:"addr,required"`
-	Namespace string                    `json:"namespace,omitempty"`
-	Insecure  bool                      `json:"insecure,omitempty"`
-	Auth      VaultSecretSpecConfigAuth `json:"auth,required"`
+	Addr string `json:"addr,omitempty"`
+	// Addrs is an ordered list of vault addresses, the first healthy one is used. Addr is ignored if set.
+	Addrs     []string `json:"addrs,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	// Insecure skips the verification of the vault server's certificate
+	Insecure *bool `json:"insecure,omitempty"`
+	// CABundle is a PEM encoded CA bundle used to verify the vault server's certificate
+	CABundle string `json:"caBundle,omitempty"`
+	// CASecretRef is a reference to a secret's key containing a PEM encoded CA bundle, located in the custom resource's namespace
+	CASecretRef *SecretKeyRef `json:"caSecretRef,omitempty"`
+	// CAConfigMapRef is a reference to a config map's key containing a PEM encoded CA bundle, located in the custom resource's namespace
+	CAConfigMapRef *ConfigMapKeyRef `json:"caConfigMapRef,omitempty"`
+	// TLSServerName is the name used to verify the vault server's certificate, defaults to the host of addr
+	TLSServerName string `json:"tlsServerName,omitempty"`
+	// ClientCertSecretName is the name of a kubernetes.io/tls secret containing a client certificate and key
+	// presented to the vault server, located in the custom resource's namespace
+	ClientCertSecretName string `json:"clientCertSecretName,omitempty"`
+	// Consistency is how reads are made consistent with previous requests when served by Vault Enterprise
+	// performance standby nodes: forwardActive, retry or bestEffort (default)
+	// +kubebuilder:validation:Enum=bestEffort;forwardActive;retry
+	Consistency string                    `json:"consistency,omitempty"`
+	Auth        VaultSecretSpecConfigAuth `json:"auth,omitempty"`
+	// AuthChain is a list of auth methods tried in order until a login succeeds, Auth is ignored if set
+	AuthChain []VaultSecretSpecConfigAuth `json:"authChain,omitempty"`
 }
 
 // VaultSecretSpecConfigAuth Mean of authentication for Vault
 type VaultSecretSpecConfigAuth struct {
-	Token      string             `json:"token,omitempty"`
+	// Token is a bare vault token
+	// Deprecated: use TokenSecretRef instead to avoid exposing the token in the custom resource
+	Token string `json:"token,omitempty"`
+	// TokenSecretRef is a reference to a secret's key containing a vault token, located in the custom resource's namespace
+	TokenSecretRef *SecretKeyRef `json:"tokenSecretRef,omitempty"`
+	// TokenFile is the path of a file on the operator's side containing a vault token (e.g. a Vault Agent sink)
+	// The file is watched and the token is reloaded when it changes
+	// Only allowed in the operator's default configuration
+	TokenFile  string             `json:"tokenFile,omitempty"`
 	Kubernetes KubernetesAuthType `json:"kubernetes,omitempty"`
 	AppRole    AppRoleAuthType    `json:"approle,omitempty"`
+	JWT        JWTAuthType        `json:"jwt,omitempty"`
+	Cert       CertAuthType       `json:"cert,omitempty"`
+	UserPass   UserPassAuthType   `json:"userpass,omitempty"`
+	LDAP       UserPassAuthType   `json:"ldap,omitempty"`
+	AWS        AWSAuthType        `json:"aws,omitempty"`
 }
 
 // KubernetesAuthType Kubernetes authentication type
@@ -55,13 +132,96 @@ type KubernetesAuthType struct {
 	Cluster string `json:"cluster,required"`
 	// ServiceAccount to use for authentication, using "default" if not provided
 	ServiceAccount string `json:"serviceAccount,omitempty"`
+	// Audiences of the token requested for the service account, using the api server's audiences if not provided
+	Audiences []string `json:"audiences,omitempty"`
+	// ExpirationSeconds is the requested validity duration of the token, using 600 seconds if not provided
+	ExpirationSeconds int64 `json:"expirationSeconds,omitempty"`
+	// UseLegacyTokenSecret reads the token from the secret associated with the service account
+	// instead of requesting a new one using the TokenRequest API
+	UseLegacyTokenSecret bool `json:"useLegacyTokenSecret,omitempty"`
 }
 
 // AppRoleAuthType AppRole authentication type
 type AppRoleAuthType struct {
 	Name     string `json:"name,omitempty"`
 	RoleID   string `json:"roleId,required"`
-	SecretID string `json:"secretId,required"`
+	SecretID string `json:"secretId,omitempty"`
+	// SecretIDSecretRef is a reference to a secret's key containing the SecretID, located in the custom resource's namespace
+	SecretIDSecretRef *SecretKeyRef `json:"secretIdSecretRef,omitempty"`
+	// SecretIDWrapped indicates that SecretIDSecretRef contains a response-wrapping token to unwrap to get the SecretID
+	SecretIDWrapped bool `json:"secretIdWrapped,omitempty"`
+}
+
+// JWTAuthType JWT/OIDC authentication type
+// The JWT is taken from the first source configured in the following order:
+// serviceAccount, secretRef, file
+type JWTAuthType struct {
+	// Name is the path of the auth method, using "jwt" if not provided
+	Name string `json:"name,omitempty"`
+	Role string `json:"role,required"`
+	// ServiceAccount to request a token for, located in the custom resource's namespace
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	// Audiences of the token requested for the service account
+	Audiences []string `json:"audiences,omitempty"`
+	// ExpirationSeconds is the requested validity duration of the token, using 600 seconds if not provided
+	ExpirationSeconds int64 `json:"expirationSeconds,omitempty"`
+	// SecretRef is a reference to a secret's key containing the JWT, located in the custom resource's namespace
+	SecretRef *SecretKeyRef `json:"secretRef,omitempty"`
+	// File is the path to a file containing the JWT on the operator's filesystem (e.g. a projected volume)
+	// Only allowed in the operator's default configuration
+	File string `json:"file,omitempty"`
+}
+
+// CertAuthType TLS certificates authentication type
+type CertAuthType struct {
+	// Name is the path of the auth method, using "cert" if not provided
+	Name string `json:"name,omitempty"`
+	// Role is the certificate role to authenticate against, vault tries all roles if not provided
+	Role string `json:"role,omitempty"`
+	// SecretName is the name of a kubernetes.io/tls secret containing the client certificate and key,
+	// located in the custom resource's namespace
+	SecretName string `json:"secretName,required"`
+}
+
+// UserPassAuthType Username and password authentication type (userpass or ldap)
+type UserPassAuthType struct {
+	// Name is the path of the auth method, using "userpass" or "ldap" if not provided
+	Name string `json:"name,omitempty"`
+	// SecretName is the name of a secret containing the credentials, located in the custom resource's namespace
+	SecretName string `json:"secretName,required"`
+	// UsernameKey is the secret's key containing the username, using "username" if not provided
+	UsernameKey string `json:"usernameKey,omitempty"`
+	// PasswordKey is the secret's key containing the password, using "password" if not provided
+	PasswordKey string `json:"passwordKey,omitempty"`
+}
+
+// AWSAuthType AWS IAM authentication type
+type AWSAuthType struct {
+	// Name is the path of the auth method, using "aws" if not provided
+	Name string `json:"name,omitempty"`
+	Role string `json:"role,required"`
+	// STSRegion is the region used to sign the sts:GetCallerIdentity request, using "us-east-1" if not provided
+	STSRegion string `json:"stsRegion,omitempty"`
+	// STSEndpoint overrides the endpoint of the STS service
+	STSEndpoint string `json:"stsEndpoint,omitempty"`
+	// IAMServerIDHeaderValue is the value of the X-Vault-AWS-IAM-Server-ID header, if configured on vault side
+	IAMServerIDHeaderValue string `json:"iamServerIdHeaderValue,omitempty"`
+	// CredentialsSecretName is the name of a secret containing static credentials (AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+	// and optionally AWS_SESSION_TOKEN keys), located in the custom resource's namespace.
+	// If not provided, the operator's web identity credentials (IRSA) are used.
+	CredentialsSecretName string `json:"credentialsSecretName,omitempty"`
+}
+
+// SecretKeyRef References a key of a secret
+type SecretKeyRef struct {
+	Name string `json:"name,required"`
+	Key  string `json:"key,required"`
+}
+
+// ConfigMapKeyRef References a key of a config map
+type ConfigMapKeyRef struct {
+	Name string `json:"name,required"`
+	Key  string `json:"key,required"`
 }
 
 // VaultSecretSpecSecret Defines secrets to create from Vault
@@ -69,13 +229,44 @@ type VaultSecretSpecSecret struct {
 	// Key name in the secret to create
 	SecretKey string `json:"secretKey,required"`
 	// Path of the key-value storage
-	KvPath string `json:"kvPath,required"`
+	KvPath string `json:"kvPath,omitempty"`
 	// Path of the vault secret
-	Path string `json:"path,required"`
+	Path string `json:"path,omitempty"`
 	// Field to retrieve from the path
-	Field string `json:"field,required"`
+	Field string `json:"field,omitempty"`
 	// KvVersion is the version of the KV backend, if unspecified, try to automatically determine it
 	KvVersion int `json:"kvVersion,omitempty"`
+	// Namespace is the vault namespace to read the secret from, overrides config.namespace if set
+	Namespace string `json:"namespace,omitempty"`
+	// Database reads dynamic credentials from a database secrets engine, KvPath, Path and KvVersion are ignored if set
+	Database *DatabaseSecretSource `json:"database,omitempty"`
+	// Transit decrypts a ciphertext using a transit secrets engine, KvPath, Path, KvVersion and Field are ignored if set
+	Transit *TransitSecretSource `json:"transit,omitempty"`
+}
+
+// DatabaseSecretSource is a role of a database secrets engine to read dynamic credentials from
+type DatabaseSecretSource struct {
+	// Mount is the path of the database secrets engine, defaults to database
+	Mount string `json:"mount,omitempty"`
+	// Role is the name of the role to read credentials from
+	Role string `json:"role"`
+	// GracePeriod is the time to wait before revoking the previous credentials once rotated, defaults to 5m
+	GracePeriod metav1.Duration `json:"gracePeriod,omitempty"`
+}
+
+// TransitSecretSource is a ciphertext to decrypt using a transit secrets engine
+// The ciphertext is taken from Ciphertext or CiphertextConfigMapRef
+type TransitSecretSource struct {
+	// Mount is the path of the transit secrets engine, defaults to transit
+	Mount string `json:"mount,omitempty"`
+	// Key is the name of the encryption key
+	Key string `json:"key"`
+	// Ciphertext is the ciphertext to decrypt (vault:v1:...)
+	Ciphertext string `json:"ciphertext,omitempty"`
+	// CiphertextConfigMapRef is a reference to a config map's key containing the ciphertext, located in the custom resource's namespace
+	CiphertextConfigMapRef *ConfigMapKeyRef `json:"ciphertextConfigMapRef,omitempty"`
+	// Context is the base64 encoded context used to derive the key, if the key supports derivation
+	Context string `json:"context,omitempty"`
 }
 
 // VaultSecretStatus Status field regarding last custom resource process
@@ -83,6 +274,28 @@ type VaultSecretSpecSecret struct {
 type VaultSecretStatus struct {
 	// +listType=set
 	Entries []VaultSecretStatusEntry `json:"entries,omitempty"`
+	// AuthMethod is the auth method used to login to vault during last process
+	AuthMethod string `json:"authMethod,omitempty"`
+	// AuthError is the error which prevented to login to vault during last process, if any
+	AuthError string `json:"authError,omitempty"`
+	// Endpoint is the vault address used during last process
+	Endpoint string `json:"endpoint,omitempty"`
+	// AuthErrorReason is a machine-readable reason of AuthError, if known (e.g. ServiceAccountNotFound)
+	AuthErrorReason string `json:"authErrorReason,omitempty"`
+	// Certificate is the status of the certificate issued from spec.pki
+	Certificate *VaultSecretStatusCertificate `json:"certificate,omitempty"`
+}
+
+// VaultSecretStatusCertificate is the status of a certificate issued from a PKI secrets engine
+type VaultSecretStatusCertificate struct {
+	// SerialNumber is the serial number of the current certificate
+	SerialNumber string `json:"serialNumber,omitempty"`
+	// NotAfter is the expiration time of the current certificate
+	NotAfter *metav1.Time `json:"notAfter,omitempty"`
+	// RenewalTime is the time after which the certificate is issued again
+	RenewalTime *metav1.Time `json:"renewalTime,omitempty"`
+	// Error is the error which prevented to issue the certificate during last process, if any
+	Error string `json:"error,omitempty"`
 }
 
 // VaultSecretStatusEntry Entry for the status field
@@ -25,9 +25,29 @@ import (
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *AWSAuthType) DeepCopyInto(out *AWSAuthType) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AWSAuthType.
+func (in *AWSAuthType) DeepCopy() *AWSAuthType {
+	if in == nil {
+		return nil
+	}
+	out := new(AWSAuthType)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *AppRoleAuthType) DeepCopyInto(out *AppRoleAuthType) {
 	*out = *in
+	if in.SecretIDSecretRef != nil {
+		in, out := &in.SecretIDSecretRef, &out.SecretIDSecretRef
+		*out = new(SecretKeyRef)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new AppRoleAuthType.
@@ -45,7 +65,9 @@ func (in BySecretKey) DeepCopyInto(out *BySecretKey) {
 	{
 		in := &in
 		*out = make(BySecretKey, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
 	}
 }
 
@@ -59,9 +81,85 @@ func (in BySecretKey) DeepCopy() BySecretKey {
 	return *out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CertAuthType) DeepCopyInto(out *CertAuthType) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CertAuthType.
+func (in *CertAuthType) DeepCopy() *CertAuthType {
+	if in == nil {
+		return nil
+	}
+	out := new(CertAuthType)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ConfigMapKeyRef) DeepCopyInto(out *ConfigMapKeyRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ConfigMapKeyRef.
+func (in *ConfigMapKeyRef) DeepCopy() *ConfigMapKeyRef {
+	if in == nil {
+		return nil
+	}
+	out := new(ConfigMapKeyRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DatabaseSecretSource) DeepCopyInto(out *DatabaseSecretSource) {
+	*out = *in
+	out.GracePeriod = in.GracePeriod
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DatabaseSecretSource.
+func (in *DatabaseSecretSource) DeepCopy() *DatabaseSecretSource {
+	if in == nil {
+		return nil
+	}
+	out := new(DatabaseSecretSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *JWTAuthType) DeepCopyInto(out *JWTAuthType) {
+	*out = *in
+	if in.Audiences != nil {
+		in, out := &in.Audiences, &out.Audiences
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.SecretRef != nil {
+		in, out := &in.SecretRef, &out.SecretRef
+		*out = new(SecretKeyRef)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new JWTAuthType.
+func (in *JWTAuthType) DeepCopy() *JWTAuthType {
+	if in == nil {
+		return nil
+	}
+	out := new(JWTAuthType)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *KubernetesAuthType) DeepCopyInto(out *KubernetesAuthType) {
 	*out = *in
+	if in.Audiences != nil {
+		in, out := &in.Audiences, &out.Audiences
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new KubernetesAuthType.
@@ -74,6 +172,71 @@ func (in *KubernetesAuthType) DeepCopy() *KubernetesAuthType {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PKIPrivateKey) DeepCopyInto(out *PKIPrivateKey) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PKIPrivateKey.
+func (in *PKIPrivateKey) DeepCopy() *PKIPrivateKey {
+	if in == nil {
+		return nil
+	}
+	out := new(PKIPrivateKey)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SecretKeyRef) DeepCopyInto(out *SecretKeyRef) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SecretKeyRef.
+func (in *SecretKeyRef) DeepCopy() *SecretKeyRef {
+	if in == nil {
+		return nil
+	}
+	out := new(SecretKeyRef)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TransitSecretSource) DeepCopyInto(out *TransitSecretSource) {
+	*out = *in
+	if in.CiphertextConfigMapRef != nil {
+		in, out := &in.CiphertextConfigMapRef, &out.CiphertextConfigMapRef
+		*out = new(ConfigMapKeyRef)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TransitSecretSource.
+func (in *TransitSecretSource) DeepCopy() *TransitSecretSource {
+	if in == nil {
+		return nil
+	}
+	out := new(TransitSecretSource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *UserPassAuthType) DeepCopyInto(out *UserPassAuthType) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new UserPassAuthType.
+func (in *UserPassAuthType) DeepCopy() *UserPassAuthType {
+	if in == nil {
+		return nil
+	}
+	out := new(UserPassAuthType)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VaultSecret) DeepCopyInto(out *VaultSecret) {
 	*out = *in
@@ -136,11 +299,18 @@ func (in *VaultSecretList) DeepCopyObject() runtime.Object {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VaultSecretSpec) DeepCopyInto(out *VaultSecretSpec) {
 	*out = *in
-	out.Config = in.Config
+	in.Config.DeepCopyInto(&out.Config)
 	if in.Secrets != nil {
 		in, out := &in.Secrets, &out.Secrets
 		*out = make([]VaultSecretSpecSecret, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.PKI != nil {
+		in, out := &in.PKI, &out.PKI
+		*out = new(VaultSecretSpecPKI)
+		(*in).DeepCopyInto(*out)
 	}
 	if in.SecretLabels != nil {
 		in, out := &in.SecretLabels, &out.SecretLabels
@@ -172,7 +342,34 @@ func (in *VaultSecretSpec) DeepCopy() *VaultSecretSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VaultSecretSpecConfig) DeepCopyInto(out *VaultSecretSpecConfig) {
 	*out = *in
-	out.Auth = in.Auth
+	if in.Addrs != nil {
+		in, out := &in.Addrs, &out.Addrs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Insecure != nil {
+		in, out := &in.Insecure, &out.Insecure
+		*out = new(bool)
+		**out = **in
+	}
+	if in.CASecretRef != nil {
+		in, out := &in.CASecretRef, &out.CASecretRef
+		*out = new(SecretKeyRef)
+		**out = **in
+	}
+	if in.CAConfigMapRef != nil {
+		in, out := &in.CAConfigMapRef, &out.CAConfigMapRef
+		*out = new(ConfigMapKeyRef)
+		**out = **in
+	}
+	in.Auth.DeepCopyInto(&out.Auth)
+	if in.AuthChain != nil {
+		in, out := &in.AuthChain, &out.AuthChain
+		*out = make([]VaultSecretSpecConfigAuth, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultSecretSpecConfig.
@@ -188,8 +385,18 @@ func (in *VaultSecretSpecConfig) DeepCopy() *VaultSecretSpecConfig {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VaultSecretSpecConfigAuth) DeepCopyInto(out *VaultSecretSpecConfigAuth) {
 	*out = *in
-	out.Kubernetes = in.Kubernetes
-	out.AppRole = in.AppRole
+	if in.TokenSecretRef != nil {
+		in, out := &in.TokenSecretRef, &out.TokenSecretRef
+		*out = new(SecretKeyRef)
+		**out = **in
+	}
+	in.Kubernetes.DeepCopyInto(&out.Kubernetes)
+	in.AppRole.DeepCopyInto(&out.AppRole)
+	in.JWT.DeepCopyInto(&out.JWT)
+	out.Cert = in.Cert
+	out.UserPass = in.UserPass
+	out.LDAP = in.LDAP
+	out.AWS = in.AWS
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultSecretSpecConfigAuth.
@@ -202,9 +409,51 @@ func (in *VaultSecretSpecConfigAuth) DeepCopy() *VaultSecretSpecConfigAuth {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VaultSecretSpecPKI) DeepCopyInto(out *VaultSecretSpecPKI) {
+	*out = *in
+	if in.AltNames != nil {
+		in, out := &in.AltNames, &out.AltNames
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.IPSANs != nil {
+		in, out := &in.IPSANs, &out.IPSANs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.URISANs != nil {
+		in, out := &in.URISANs, &out.URISANs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	out.TTL = in.TTL
+	out.PrivateKey = in.PrivateKey
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultSecretSpecPKI.
+func (in *VaultSecretSpecPKI) DeepCopy() *VaultSecretSpecPKI {
+	if in == nil {
+		return nil
+	}
+	out := new(VaultSecretSpecPKI)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VaultSecretSpecSecret) DeepCopyInto(out *VaultSecretSpecSecret) {
 	*out = *in
+	if in.Database != nil {
+		in, out := &in.Database, &out.Database
+		*out = new(DatabaseSecretSource)
+		**out = **in
+	}
+	if in.Transit != nil {
+		in, out := &in.Transit, &out.Transit
+		*out = new(TransitSecretSource)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultSecretSpecSecret.
@@ -223,7 +472,14 @@ func (in *VaultSecretStatus) DeepCopyInto(out *VaultSecretStatus) {
 	if in.Entries != nil {
 		in, out := &in.Entries, &out.Entries
 		*out = make([]VaultSecretStatusEntry, len(*in))
-		copy(*out, *in)
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Certificate != nil {
+		in, out := &in.Certificate, &out.Certificate
+		*out = new(VaultSecretStatusCertificate)
+		(*in).DeepCopyInto(*out)
 	}
 }
 
@@ -237,10 +493,33 @@ func (in *VaultSecretStatus) DeepCopy() *VaultSecretStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *VaultSecretStatusCertificate) DeepCopyInto(out *VaultSecretStatusCertificate) {
+	*out = *in
+	if in.NotAfter != nil {
+		in, out := &in.NotAfter, &out.NotAfter
+		*out = (*in).DeepCopy()
+	}
+	if in.RenewalTime != nil {
+		in, out := &in.RenewalTime, &out.RenewalTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultSecretStatusCertificate.
+func (in *VaultSecretStatusCertificate) DeepCopy() *VaultSecretStatusCertificate {
+	if in == nil {
+		return nil
+	}
+	out := new(VaultSecretStatusCertificate)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *VaultSecretStatusEntry) DeepCopyInto(out *VaultSecretStatusEntry) {
 	*out = *in
-	out.Secret = in.Secret
+	in.Secret.DeepCopyInto(&out.Secret)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new VaultSecretStatusEntry.
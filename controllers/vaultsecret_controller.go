@@ -21,12 +21,15 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
 	maupuv1beta1 "github.com/nmaupu/vault-secret/api/v1beta1"
+	"github.com/nmaupu/vault-secret/pkg/k8sutils"
 	nmvault "github.com/nmaupu/vault-secret/pkg/vault"
 	appVersion "github.com/nmaupu/vault-secret/version"
 	corev1 "k8s.io/api/core/v1"
@@ -34,6 +37,9 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -51,6 +57,8 @@ const (
 	TimeFormat = "2006-01-02_15-04-05"
 	// MinTimeMsBetweenSecretUpdate avoid a secret to be updated too often
 	MinTimeMsBetweenSecretUpdate = time.Millisecond * 500
+	// TransitPlaintextField is the field containing the decrypted value of a transit entry
+	TransitPlaintextField = "plaintext"
 )
 
 var (
@@ -61,6 +69,10 @@ var (
 	secretsLastUpdateTime      = make(map[string]time.Time)
 	secretsLastUpdateTimeMutex sync.Mutex
 
+	// deprecationWarnings stores the generation of the custom resources for which a deprecation warning has been emitted
+	deprecationWarnings      = make(map[string]int64)
+	deprecationWarningsMutex sync.Mutex
+
 	// LabelsFilter filters events on labels
 	LabelsFilter map[string]string
 )
@@ -68,9 +80,22 @@ var (
 // VaultSecretReconciler reconciles a VaultSecret object
 type VaultSecretReconciler struct {
 	client.Client
+	Clientset    kubernetes.Interface
+	Recorder     record.EventRecorder
+	TokenManager *nmvault.TokenManager
+	// LeaseManager keeps the dynamic credentials read by the custom resources
+	LeaseManager *nmvault.LeaseManager
 	Log          logr.Logger
 	Scheme       *runtime.Scheme
 	LabelsFilter map[string]string
+	// DefaultConfig is the operator-wide vault configuration used for the fields not set in custom resources
+	DefaultConfig *maupuv1beta1.VaultSecretSpecConfig
+	// DefaultCACert is the PEM encoded CA bundle used to verify the default vault server's certificate
+	DefaultCACert []byte
+	// IdentityPolicy selects the service account used by the Kubernetes auth method
+	IdentityPolicy *k8sutils.IdentityPolicy
+	// ClientFactory creates the vault clients sharing their connections
+	ClientFactory *nmvault.ClientFactory
 }
 
 // AddLabelFilter adds a label for filtering events
@@ -82,10 +107,40 @@ func AddLabelFilter(key, value string) {
 	LabelsFilter[key] = value
 }
 
+// warnDeprecatedOptions emits a warning event if the custom resource uses deprecated options
+// The event is emitted once per generation of the custom resource, not on every reconcile
+func (r *VaultSecretReconciler) warnDeprecatedOptions(cr *maupuv1beta1.VaultSecret) {
+	if !cr.Spec.Config.UsesInlineToken() {
+		return
+	}
+
+	key := types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name}.String()
+	deprecationWarningsMutex.Lock()
+	defer deprecationWarningsMutex.Unlock()
+	if generation, found := deprecationWarnings[key]; found && generation == cr.Generation {
+		return
+	}
+	deprecationWarnings[key] = cr.Generation
+
+	r.Recorder.Event(cr, corev1.EventTypeWarning, "DeprecatedInlineToken",
+		"token is deprecated in config.auth and config.authChain, use tokenSecretRef instead")
+}
+
+// forgetDeprecationWarning forgets the warnings emitted for a deleted custom resource
+func forgetDeprecationWarning(key string) {
+	deprecationWarningsMutex.Lock()
+	defer deprecationWarningsMutex.Unlock()
+
+	delete(deprecationWarnings, key)
+}
+
 // +kubebuilder:rbac:groups=maupu.org,resources=vaultsecrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=maupu.org,resources=vaultsecrets/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=serviceaccounts/token,verbs=create
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 // Reconcile reads that state of the cluster for a VaultSecret object and makes changes based on the state read
 // and what is in the VaultSecret.Spec
@@ -105,6 +160,10 @@ func (r *VaultSecretReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 			// Owned objects are automatically garbage collected. For additional cleanup logic use finalizers.
 			// Return and don't requeue
 			log.Info("VaultSecret resource not found. Ignoring since object must be deleted")
+			// Its vault token is not needed anymore
+			r.TokenManager.Release(req.NamespacedName.String())
+			r.LeaseManager.Release(req.NamespacedName.String())
+			forgetDeprecationWarning(req.NamespacedName.String())
 			return ctrl.Result{}, nil
 		}
 
@@ -113,6 +172,8 @@ func (r *VaultSecretReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		return ctrl.Result{}, err
 	}
 
+	r.warnDeprecatedOptions(CRInstance)
+
 	// Only updating stuff if two updates are not too close from each other
 	// See secretsLastUpdateTime and MinTimeMsBetweenSecretUpdate variables
 	updateTimeKey := fmt.Sprintf("%s/%s", CRInstance.GetNamespace(), CRInstance.Spec.SecretName)
@@ -145,7 +206,9 @@ func (r *VaultSecretReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		}
 
 		secretType := CRInstance.Spec.SecretType
-		if secretType == "" {
+		if secretType == "" && CRInstance.Spec.PKI != nil {
+			secretType = corev1.SecretTypeTLS
+		} else if secretType == "" {
 			secretType = "Opaque"
 		}
 
@@ -154,7 +217,8 @@ func (r *VaultSecretReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		}
 
 		var secretData map[string][]byte
-		var statusEntries []maupuv1beta1.VaultSecretStatusEntry
+		var secretAnnotations map[string]string
+		var status *maupuv1beta1.VaultSecretStatus
 		var operationResult controllerutil.OperationResult
 
 		secret := &corev1.Secret{
@@ -173,7 +237,7 @@ func (r *VaultSecretReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 
 				// Only read secret data once
 				if secretData == nil {
-					secretData, statusEntries, err = r.readSecretData(CRInstance)
+					secretData, secretAnnotations, status, err = r.readSecretData(CRInstance, secret)
 					if err != nil {
 						return err
 					}
@@ -202,30 +266,44 @@ func (r *VaultSecretReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 					secret.Labels["lastUpdate"] = time.Now().Format(TimeFormat)
 				}
 				secret.Type = secretType
-				secret.Annotations = CRInstance.Spec.SecretAnnotations
+				secret.Annotations = make(map[string]string)
+				for k, v := range CRInstance.Spec.SecretAnnotations {
+					secret.Annotations[k] = v
+				}
+				for k, v := range secretAnnotations {
+					secret.Annotations[k] = v
+				}
 
 				if err = controllerutil.SetControllerReference(CRInstance, secret, r.Scheme); err != nil {
 					return err
 				}
 
 				// Here no error occurred, check if some field failed to update (status will be updated later on)
-				for i := range statusEntries {
-					if !statusEntries[i].Status {
+				for i := range status.Entries {
+					if !status.Entries[i].Status {
 						return fmt.Errorf("Some errors occurred while reading from vault, see VaultSecret status field for details")
 					}
 				}
+				if status.Certificate != nil && status.Certificate.Error != "" {
+					return fmt.Errorf("Unable to issue certificate, see VaultSecret status field for details")
+				}
 
 				return nil
 			})
 			return err
 		})
 
+		// The secret holds the current dynamic credentials, the previous ones can be revoked
+		if err == nil {
+			r.LeaseManager.Commit(req.NamespacedName.String())
+		}
+
 		// Update the VaultSecret Status only if it changed
 		var statusEntriesErr error
-		if statusEntries != nil && !equality.Semantic.DeepEqual(CRInstance.Status.Entries, statusEntries) {
-			CRInstance.Status.Entries = statusEntries
-			if statusEntriesErr = r.Client.Status().Update(context.TODO(), CRInstance); err != nil {
-				reqLogger.Error(err, "Failed to update VaultSecret status")
+		if status != nil && !equality.Semantic.DeepEqual(CRInstance.Status, *status) {
+			CRInstance.Status = *status
+			if statusEntriesErr = r.Client.Status().Update(context.TODO(), CRInstance); statusEntriesErr != nil {
+				reqLogger.Error(statusEntriesErr, "Failed to update VaultSecret status")
 				return reconcile.Result{}, statusEntriesErr
 			}
 		}
@@ -251,28 +329,82 @@ func (r *VaultSecretReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error)
 		}
 	}
 
-	return reconcile.Result{RequeueAfter: CRInstance.Spec.SyncPeriod.Duration}, err
+	// Processing again in time to renew the dynamic credentials' leases and the certificate
+	result := reconcile.Result{RequeueAfter: CRInstance.Spec.SyncPeriod.Duration}
+	renewals := []time.Time{r.LeaseManager.NextRenewal(req.NamespacedName.String())}
+	if CRInstance.Status.Certificate != nil && CRInstance.Status.Certificate.RenewalTime != nil {
+		renewals = append(renewals, CRInstance.Status.Certificate.RenewalTime.Time)
+	}
+	for _, renewal := range renewals {
+		if renewal.IsZero() {
+			continue
+		}
+		renewIn := time.Until(renewal)
+		if renewIn < MinTimeMsBetweenSecretUpdate {
+			renewIn = MinTimeMsBetweenSecretUpdate
+		}
+		if result.RequeueAfter == 0 || renewIn < result.RequeueAfter {
+			result.RequeueAfter = renewIn
+		}
+	}
+
+	return result, err
 }
 
-func (r *VaultSecretReconciler) readSecretData(cr *maupuv1beta1.VaultSecret) (map[string][]byte, []maupuv1beta1.VaultSecretStatusEntry, error) {
+// readSecretData reads the secret's data from vault, current is the existing secret
+// The annotations describing the data (e.g. the certificate) are returned along with it
+func (r *VaultSecretReconciler) readSecretData(cr *maupuv1beta1.VaultSecret, current *corev1.Secret) (map[string][]byte, map[string]string, *maupuv1beta1.VaultSecretStatus, error) {
 	reqLogger := log.WithValues("func", "readSecretData")
 
+	// Files of the operator are only read from the operator's default configuration
+	if err := cr.Spec.Config.CheckOperatorFiles(); err != nil {
+		return nil, nil, authErrorStatus(err), err
+	}
+
+	// The operator's CA bundle only applies to the default vault server
+	defaultServer := !cr.Spec.Config.HasAddress()
+
+	// Completing the custom resource's configuration with the operator's default one
+	cr = cr.DeepCopy()
+	config, err := cr.Spec.Config.WithIdentityPolicy(r.IdentityPolicy)
+	if err != nil {
+		return nil, nil, authErrorStatus(err), err
+	}
+	cr.Spec.Config = config.WithDefaults(r.DefaultConfig)
+	if cr.Spec.Config.Addr == "" && len(cr.Spec.Config.Addrs) == 0 {
+		return nil, nil, nil, fmt.Errorf("No vault address configured, please set config.addr or configure the operator's default address")
+	}
+
 	// Authentication provider
-	authProvider, err := cr.GetVaultAuthProvider(r.Client)
+	authProvider, err := cr.GetVaultAuthProvider(r.Client, r.Clientset, r.IdentityPolicy)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, authErrorStatus(err), err
 	}
 
-	// Processing vault login
-	vaultConfig := nmvault.NewConfig(cr.Spec.Config.Addr)
-	vaultConfig.Namespace = cr.Spec.Config.Namespace
-	vaultConfig.Insecure = cr.Spec.Config.Insecure
-	vClient, err := authProvider.Login(vaultConfig)
+	// Processing vault login, reusing the token from a previous login if still valid
+	tokenOwner := types.NamespacedName{Namespace: cr.Namespace, Name: cr.Name}.String()
+	vaultConfig, err := cr.GetVaultConfig(r.Client)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(vaultConfig.CACert) == 0 && defaultServer {
+		vaultConfig.CACert = r.DefaultCACert
+	}
+	vaultConfig.ClientFactory = r.ClientFactory
+	if err := vaultConfig.SelectAddress(); err != nil {
+		return nil, nil, nil, err
+	}
+	vClient, err := r.TokenManager.Client(tokenOwner, vaultConfig, authProvider)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, authErrorStatus(err), err
 	}
 
 	vaultClient := nmvault.NewCachedClient(vClient)
+	readStart := time.Now()
+	// Only login again once if access is denied, the token may have been revoked
+	loggedInAgain := false
+	// Only fail over once to another vault server if the current one is not reachable
+	failedOver := false
 
 	// Init
 	secrets := map[string][]byte{}
@@ -281,33 +413,76 @@ func (r *VaultSecretReconciler) readSecretData(cr *maupuv1beta1.VaultSecret) (ma
 	specSecrets := append(make([]maupuv1beta1.VaultSecretSpecSecret, 0, len(cr.Spec.Secrets)), cr.Spec.Secrets...)
 	sort.Sort(maupuv1beta1.BySecretKey(specSecrets))
 
-	statusEntries := make([]maupuv1beta1.VaultSecretStatusEntry, 0, len(cr.Spec.Secrets))
+	crStatus := &maupuv1beta1.VaultSecretStatus{
+		Entries: make([]maupuv1beta1.VaultSecretStatusEntry, 0, len(cr.Spec.Secrets)),
+	}
 
 	// Creating secret data from CR
 	for _, s := range specSecrets {
-		var err error
 		errMessage := ""
 		rootErrMessage := ""
 		var status bool
 
+		// Checking the entry and reading its input from kubernetes before reading vault
+		field, ciphertext, err := r.secretEntryInput(cr.Namespace, s)
+
 		// Vault read
-		reqLogger.Info("Reading vault", "KvPath", s.KvPath, "Path", s.Path, "KvVersion", s.KvVersion)
-		secret, err := vaultClient.Read(s.KvVersion, s.KvPath, s.Path)
+		read := func() (map[string]interface{}, error) {
+			switch {
+			case s.Database != nil:
+				return r.readDatabaseCredentials(tokenOwner, vaultClient, s)
+			case s.Transit != nil:
+				return decryptCiphertext(vaultClient, s, ciphertext)
+			}
+			reqLogger.Info("Reading vault", "Namespace", s.Namespace, "KvPath", s.KvPath, "Path", s.Path, "KvVersion", s.KvVersion)
+			return vaultClient.Read(s.KvVersion, s.Namespace, s.KvPath, s.Path)
+		}
+		var secret map[string]interface{}
+		if err == nil {
+			secret, err = read()
+			if nmvault.IsConnectionError(err) && len(vaultConfig.Addresses) > 1 && !failedOver {
+				reqLogger.Info("Vault server not reachable, failing over", "Address", vaultConfig.Address)
+				failedOver = true
+				nmvault.MarkUnhealthy(vaultConfig, err)
+				if err := vaultConfig.SelectAddress(); err != nil {
+					return nil, nil, nil, err
+				}
+				vClient, err = r.TokenManager.Client(tokenOwner, vaultConfig, authProvider)
+				if err != nil {
+					return nil, nil, authErrorStatus(err), err
+				}
+				vaultClient = nmvault.NewCachedClient(vClient)
+				secret, err = read()
+			}
+			if nmvault.IsPermissionDenied(err) && !loggedInAgain {
+				loggedInAgain = true
+				// Only login again if the token is not valid anymore, access is denied by a policy otherwise
+				if r.TokenManager.Invalidate(vaultConfig, authProvider) {
+					reqLogger.Info("Permission denied, vault token not valid anymore, login again")
+					vClient, err = r.TokenManager.Client(tokenOwner, vaultConfig, authProvider)
+					if err != nil {
+						return nil, nil, authErrorStatus(err), err
+					}
+					vaultClient = nmvault.NewCachedClient(vClient)
+					secret, err = read()
+				}
+			}
+		}
 
 		if err != nil {
 			rootErrMessage = err.Error()
 			errMessage = "Problem occurred while reading secret"
 			status = false
-		} else if secret == nil || secret[s.Field] == nil || secret[s.Field] == "" {
+		} else if !fieldExists(s, secret, field) {
 			errMessage = "Field does not exist"
 			status = false
 		} else {
 			status = true
-			secrets[s.SecretKey] = ([]byte)(secret[s.Field].(string))
+			secrets[s.SecretKey] = ([]byte)(secret[field].(string))
 		}
 
 		// Updating CR Status field
-		statusEntries = append(statusEntries, maupuv1beta1.VaultSecretStatusEntry{
+		crStatus.Entries = append(crStatus.Entries, maupuv1beta1.VaultSecretStatusEntry{
 			Secret:    s,
 			Status:    status,
 			Message:   errMessage,
@@ -315,7 +490,120 @@ func (r *VaultSecretReconciler) readSecretData(cr *maupuv1beta1.VaultSecret) (ma
 		})
 	}
 
+	// Dynamic credentials not referenced anymore
+	r.LeaseManager.ReleaseUnused(tokenOwner, readStart)
+
+	var annotations map[string]string
+	if cr.Spec.PKI != nil {
+		var certificate map[string][]byte
+		certificate, annotations, crStatus.Certificate = readCertificate(cr.Spec.PKI, vClient, current.Data, current.Annotations)
+		for key, data := range certificate {
+			secrets[key] = data
+		}
+	}
+
+	crStatus.AuthMethod = r.TokenManager.AuthMethod(vaultConfig, authProvider)
+	crStatus.Endpoint = vaultConfig.Address
+
 	// Error is returned along with secret if it occurred at least once during loop
 	// In case of error, we only return secrets that we could read. The caller has to handle itself.
-	return secrets, statusEntries, nil
+	return secrets, annotations, crStatus, nil
+}
+
+// secretEntryInput checks a secret entry and returns the field to read from vault's response
+// and, for transit entries, the ciphertext to decrypt
+func (r *VaultSecretReconciler) secretEntryInput(namespace string, s maupuv1beta1.VaultSecretSpecSecret) (string, string, error) {
+	switch {
+	case s.Transit != nil:
+		if s.Transit.Key == "" {
+			return "", "", fmt.Errorf("transit.key is required")
+		}
+		ciphertext := s.Transit.Ciphertext
+		if ref := s.Transit.CiphertextConfigMapRef; ref != nil {
+			data, err := k8sutils.GetConfigMapValue(r.Client, namespace, ref.Name, ref.Key)
+			if err != nil {
+				return "", "", err
+			}
+			ciphertext = string(data)
+		}
+		if ciphertext == "" {
+			return "", "", fmt.Errorf("transit.ciphertext or transit.ciphertextConfigMapRef is required")
+		}
+		if !strings.HasPrefix(strings.TrimSpace(ciphertext), nmvault.TransitCiphertextPrefix) {
+			return "", "", fmt.Errorf("Invalid ciphertext, it must start with %s", nmvault.TransitCiphertextPrefix)
+		}
+		return TransitPlaintextField, ciphertext, nil
+	case s.Database != nil:
+		if s.Database.Role == "" {
+			return "", "", fmt.Errorf("database.role is required")
+		}
+	case s.KvPath == "":
+		return "", "", fmt.Errorf("kvPath is required")
+	}
+
+	if s.Field == "" {
+		return "", "", fmt.Errorf("field is required")
+	}
+	return s.Field, "", nil
+}
+
+// fieldExists checks whether the field read from vault for a secret entry exists
+// A decrypted plaintext can legitimately be empty, other fields have to be set
+func fieldExists(s maupuv1beta1.VaultSecretSpecSecret, secret map[string]interface{}, field string) bool {
+	if secret == nil {
+		return false
+	}
+	if s.Transit != nil {
+		_, found := secret[field]
+		return found
+	}
+	return secret[field] != nil && secret[field] != ""
+}
+
+// decryptCiphertext decrypts the ciphertext of a transit entry, the plaintext is returned in the TransitPlaintextField field
+func decryptCiphertext(vaultClient *nmvault.CachedClient, s maupuv1beta1.VaultSecretSpecSecret, ciphertext string) (map[string]interface{}, error) {
+	mount := s.Transit.Mount
+	if mount == "" {
+		mount = "transit"
+	}
+
+	vClient, err := vaultClient.NamespaceClient(s.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("Decrypting ciphertext", "Namespace", s.Namespace, "Mount", mount, "Key", s.Transit.Key)
+	plaintext, err := nmvault.Decrypt(vClient, mount, s.Transit.Key, ciphertext, s.Transit.Context)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{TransitPlaintextField: string(plaintext)}, nil
+}
+
+// readDatabaseCredentials reads the dynamic credentials of a database secrets engine's role
+func (r *VaultSecretReconciler) readDatabaseCredentials(owner string, vaultClient *nmvault.CachedClient, s maupuv1beta1.VaultSecretSpecSecret) (map[string]interface{}, error) {
+	mount := s.Database.Mount
+	if mount == "" {
+		mount = "database"
+	}
+	gracePeriod := s.Database.GracePeriod.Duration
+	if gracePeriod == 0 {
+		gracePeriod = nmvault.DefaultLeaseGracePeriod
+	}
+
+	vClient, err := vaultClient.NamespaceClient(s.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.LeaseManager.Read(owner, vClient, path.Join(mount, "creds", s.Database.Role), gracePeriod)
+}
+
+// authErrorStatus returns the status of a custom resource which could not login to vault
+func authErrorStatus(err error) *maupuv1beta1.VaultSecretStatus {
+	return &maupuv1beta1.VaultSecretStatus{
+		AuthError:       err.Error(),
+		AuthErrorReason: k8sutils.ErrorReason(err),
+	}
 }
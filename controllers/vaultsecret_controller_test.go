@@ -0,0 +1,96 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	maupuv1beta1 "github.com/nmaupu/vault-secret/api/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestFieldExists(t *testing.T) {
+	kv := maupuv1beta1.VaultSecretSpecSecret{Field: "password"}
+	transit := maupuv1beta1.VaultSecretSpecSecret{Transit: &maupuv1beta1.TransitSecretSource{Key: "app"}}
+
+	tests := []struct {
+		name   string
+		s      maupuv1beta1.VaultSecretSpecSecret
+		secret map[string]interface{}
+		field  string
+		want   bool
+	}{
+		{name: "kv field", s: kv, secret: map[string]interface{}{"password": "s3cr3t"}, field: "password", want: true},
+		{name: "kv empty field", s: kv, secret: map[string]interface{}{"password": ""}, field: "password", want: false},
+		{name: "kv missing field", s: kv, secret: map[string]interface{}{"username": "app"}, field: "password", want: false},
+		{name: "kv no secret", s: kv, secret: nil, field: "password", want: false},
+		{name: "transit plaintext", s: transit, secret: map[string]interface{}{TransitPlaintextField: "s3cr3t"}, field: TransitPlaintextField, want: true},
+		{name: "transit empty plaintext", s: transit, secret: map[string]interface{}{TransitPlaintextField: ""}, field: TransitPlaintextField, want: true},
+		{name: "transit no plaintext", s: transit, secret: map[string]interface{}{}, field: TransitPlaintextField, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fieldExists(tt.s, tt.secret, tt.field); got != tt.want {
+				t.Errorf("fieldExists()=%t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarnDeprecatedOptions(t *testing.T) {
+	inline := maupuv1beta1.VaultSecretSpecConfigAuth{Token: "s.token"}
+	appRole := maupuv1beta1.VaultSecretSpecConfigAuth{AppRole: maupuv1beta1.AppRoleAuthType{RoleID: "app"}}
+
+	tests := []struct {
+		name        string
+		config      maupuv1beta1.VaultSecretSpecConfig
+		generations []int64
+		wantEvents  int
+	}{
+		{name: "no inline token", config: maupuv1beta1.VaultSecretSpecConfig{Auth: appRole},
+			generations: []int64{1, 2}, wantEvents: 0},
+		{name: "inline token, same generation", config: maupuv1beta1.VaultSecretSpecConfig{Auth: inline},
+			generations: []int64{1, 1, 1}, wantEvents: 1},
+		{name: "inline token, new generation", config: maupuv1beta1.VaultSecretSpecConfig{Auth: inline},
+			generations: []int64{1, 1, 2}, wantEvents: 2},
+		{name: "inline token in auth chain", config: maupuv1beta1.VaultSecretSpecConfig{AuthChain: []maupuv1beta1.VaultSecretSpecConfigAuth{appRole, inline}},
+			generations: []int64{1, 1}, wantEvents: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := record.NewFakeRecorder(10)
+			r := &VaultSecretReconciler{Recorder: recorder}
+			key := "ns/" + tt.name
+			defer forgetDeprecationWarning(key)
+
+			for _, generation := range tt.generations {
+				cr := &maupuv1beta1.VaultSecret{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: tt.name, Generation: generation},
+					Spec:       maupuv1beta1.VaultSecretSpec{Config: tt.config},
+				}
+				r.warnDeprecatedOptions(cr)
+			}
+
+			if got := len(recorder.Events); got != tt.wantEvents {
+				t.Errorf("events=%d, want %d", got, tt.wantEvents)
+			}
+		})
+	}
+}
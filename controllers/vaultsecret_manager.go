@@ -17,22 +17,94 @@ limitations under the License.
 package controllers
 
 import (
+	"context"
+
 	maupuv1beta1 "github.com/nmaupu/vault-secret/api/v1beta1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+const (
+	// referencedSecretsField is the index field listing the secrets a VaultSecret reads its configuration from
+	referencedSecretsField = ".spec.config.referencedSecrets"
+	// referencedConfigMapsField is the index field listing the config maps a VaultSecret reads its configuration from
+	referencedConfigMapsField = ".spec.config.referencedConfigMaps"
 )
 
 // SetupWithManager godoc
 func (r *VaultSecretReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	err := mgr.GetFieldIndexer().IndexField(context.TODO(), &maupuv1beta1.VaultSecret{}, referencedSecretsField, func(obj runtime.Object) []string {
+		// Referenced secrets may come from the operator's default configuration
+		cr := obj.(*maupuv1beta1.VaultSecret).DeepCopy()
+		cr.Spec.Config = cr.Spec.Config.WithDefaults(r.DefaultConfig)
+		return cr.GetReferencedSecrets()
+	})
+	if err != nil {
+		return err
+	}
+
+	err = mgr.GetFieldIndexer().IndexField(context.TODO(), &maupuv1beta1.VaultSecret{}, referencedConfigMapsField, func(obj runtime.Object) []string {
+		cr := obj.(*maupuv1beta1.VaultSecret).DeepCopy()
+		cr.Spec.Config = cr.Spec.Config.WithDefaults(r.DefaultConfig)
+		return cr.GetReferencedConfigMaps()
+	})
+	if err != nil {
+		return err
+	}
+
+	// Referenced secrets and config maps are not filtered on labels as they are not managed by the operator
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&maupuv1beta1.VaultSecret{}).
-		Owns(&corev1.Secret{}).
-		WithEventFilter(r.filterLabelsPredicate()).
+		For(&maupuv1beta1.VaultSecret{}, builder.WithPredicates(r.filterLabelsPredicate())).
+		Owns(&corev1.Secret{}, builder.WithPredicates(r.filterLabelsPredicate())).
+		Watches(
+			&source.Kind{Type: &corev1.Secret{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: r.referencingVaultSecrets(referencedSecretsField)},
+		).
+		Watches(
+			&source.Kind{Type: &corev1.ConfigMap{}},
+			&handler.EnqueueRequestsFromMapFunc{ToRequests: r.referencingVaultSecrets(referencedConfigMapsField)},
+		).
 		Complete(r)
 }
 
+// referencingVaultSecrets maps an object (secret or config map) to the VaultSecret objects reading their configuration from it
+// using the given index field
+func (r *VaultSecretReconciler) referencingVaultSecrets(field string) handler.ToRequestsFunc {
+	return func(o handler.MapObject) []reconcile.Request {
+		log := r.Log.WithValues("func", "referencingVaultSecrets")
+
+		vaultSecrets := &maupuv1beta1.VaultSecretList{}
+		err := r.List(context.TODO(), vaultSecrets,
+			client.InNamespace(o.Meta.GetNamespace()),
+			client.MatchingFields{field: o.Meta.GetName()})
+		if err != nil {
+			log.Error(err, "Unable to list VaultSecret objects referencing object", "Field", field, "Namespace", o.Meta.GetNamespace(), "Name", o.Meta.GetName())
+			return nil
+		}
+
+		requests := make([]reconcile.Request, 0, len(vaultSecrets.Items))
+		for _, vs := range vaultSecrets.Items {
+			if !r.matchLabelsFilter(vs.GetLabels()) {
+				continue
+			}
+			requests = append(requests, reconcile.Request{
+				NamespacedName: types.NamespacedName{Namespace: vs.Namespace, Name: vs.Name},
+			})
+		}
+
+		return requests
+	}
+}
+
 func (r *VaultSecretReconciler) filterLabelsPredicate() predicate.Predicate {
 	predFunc := func(e interface{}) bool {
 		log := r.Log.WithValues("func", "predFunc")
@@ -58,18 +130,7 @@ func (r *VaultSecretReconciler) filterLabelsPredicate() predicate.Predicate {
 		}
 
 		// If labels match, we process the event, otherwise, simply ignore it
-		// Verifying that each labels configured are present in the target object
-		for lfk, lfv := range r.LabelsFilter {
-			if val, ok := objectLabels[lfk]; ok {
-				if val != lfv {
-					return false
-				}
-			} else {
-				return false
-			}
-		}
-
-		return true
+		return r.matchLabelsFilter(objectLabels)
 	}
 
 	return predicate.Funcs{
@@ -87,3 +148,18 @@ func (r *VaultSecretReconciler) filterLabelsPredicate() predicate.Predicate {
 		},
 	}
 }
+
+// matchLabelsFilter verifies that each labels configured are present in the given object labels
+func (r *VaultSecretReconciler) matchLabelsFilter(objectLabels map[string]string) bool {
+	for lfk, lfv := range r.LabelsFilter {
+		if val, ok := objectLabels[lfk]; ok {
+			if val != lfv {
+				return false
+			}
+		} else {
+			return false
+		}
+	}
+
+	return true
+}
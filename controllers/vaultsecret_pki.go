@@ -0,0 +1,257 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	vapi "github.com/hashicorp/vault/api"
+	maupuv1beta1 "github.com/nmaupu/vault-secret/api/v1beta1"
+	nmvault "github.com/nmaupu/vault-secret/pkg/vault"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// DefaultCertificateRenewAfterPercent is the default percentage of a certificate's lifetime after which it is issued again
+	DefaultCertificateRenewAfterPercent = 67
+	// TLSCAKey is the key of the CA certificate in a kubernetes.io/tls secret
+	TLSCAKey = "ca.crt"
+	// PKIModeIssue has vault generate the private key
+	PKIModeIssue = "issue"
+	// PKIModeSign generates the private key in the operator and has vault sign a CSR
+	PKIModeSign = "sign"
+	// KeyRotationPolicyNever reuses the current private key when the certificate is renewed
+	KeyRotationPolicyNever = "never"
+	// PKISpecHashAnnotation is the annotation of the secret containing the hash of the pki spec the certificate has been issued for
+	PKISpecHashAnnotation = "maupu.org/pki-spec-hash"
+	// PKIModeAnnotation is the annotation of the secret containing the mode which produced the private key
+	PKIModeAnnotation = "maupu.org/pki-mode"
+)
+
+// readCertificate returns the certificate of the secret (tls.crt, tls.key and ca.crt keys) and the annotations
+// describing it, issuing a new one from vault if the current one does not match the spec or has to be renewed
+func readCertificate(pki *maupuv1beta1.VaultSecretSpecPKI, vClient *vapi.Client, current map[string][]byte, currentAnnotations map[string]string) (map[string][]byte, map[string]string, *maupuv1beta1.VaultSecretStatusCertificate) {
+	reqLogger := log.WithValues("func", "readCertificate")
+
+	renewAfterPercent := pki.RenewAfterPercent
+	if renewAfterPercent <= 0 {
+		renewAfterPercent = DefaultCertificateRenewAfterPercent
+	}
+
+	mode := pki.Mode
+	if mode == "" {
+		mode = PKIModeIssue
+	}
+	annotations := map[string]string{
+		PKISpecHashAnnotation: pkiSpecHash(pki),
+		PKIModeAnnotation:     mode,
+	}
+
+	// A private key produced by another mode (e.g. generated by vault) is never kept
+	sameMode := currentAnnotations[PKIModeAnnotation] == mode
+	if cert, err := parseCertificate(current[corev1.TLSCertKey]); err == nil && sameMode && privateKeyMatches(current[corev1.TLSPrivateKeyKey], pki) &&
+		currentAnnotations[PKISpecHashAnnotation] == annotations[PKISpecHashAnnotation] && certificateMatches(cert, pki) {
+		status := certificateStatus(cert, renewAfterPercent)
+		if time.Now().Before(status.RenewalTime.Time) {
+			return map[string][]byte{
+				corev1.TLSCertKey:       current[corev1.TLSCertKey],
+				corev1.TLSPrivateKeyKey: current[corev1.TLSPrivateKeyKey],
+				TLSCAKey:                current[TLSCAKey],
+			}, annotations, status
+		}
+		reqLogger.Info("Certificate has to be renewed", "SerialNumber", status.SerialNumber)
+	}
+
+	if pki.Role == "" || pki.CommonName == "" {
+		return nil, nil, &maupuv1beta1.VaultSecretStatusCertificate{Error: "pki.role and pki.commonName are required"}
+	}
+	mount := pki.Mount
+	if mount == "" {
+		mount = "pki"
+	}
+
+	certificateRequest := nmvault.CertificateRequest{
+		CommonName: pki.CommonName,
+		AltNames:   pki.AltNames,
+		IPSANs:     pki.IPSANs,
+		URISANs:    pki.URISANs,
+		TTL:        pki.TTL.Duration,
+	}
+	var issued *nmvault.Certificate
+	var err error
+	if mode == PKIModeSign {
+		var currentKey []byte
+		if sameMode {
+			currentKey = current[corev1.TLSPrivateKeyKey]
+		}
+		issued, err = signCertificate(pki, vClient, mount, certificateRequest, currentKey)
+	} else {
+		reqLogger.Info("Issuing certificate", "Mount", mount, "Role", pki.Role, "CommonName", pki.CommonName)
+		issued, err = nmvault.IssueCertificate(vClient, mount, pki.Role, certificateRequest)
+	}
+	if err != nil {
+		return nil, nil, &maupuv1beta1.VaultSecretStatusCertificate{Error: err.Error()}
+	}
+
+	cert, err := parseCertificate([]byte(issued.Certificate))
+	if err != nil {
+		return nil, nil, &maupuv1beta1.VaultSecretStatusCertificate{Error: err.Error()}
+	}
+
+	// The whole CA chain is trusted when returned by vault
+	ca := issued.IssuingCA
+	if len(issued.CAChain) > 0 {
+		ca = strings.Join(issued.CAChain, "\n")
+	}
+
+	return map[string][]byte{
+		corev1.TLSCertKey:       []byte(issued.Chain()),
+		corev1.TLSPrivateKeyKey: []byte(issued.PrivateKey),
+		TLSCAKey:                []byte(ca),
+	}, annotations, certificateStatus(cert, renewAfterPercent)
+}
+
+// signCertificate has vault sign a CSR for a private key generated by the operator, or the current one
+// if it is kept on renewal. The returned certificate contains the private key.
+func signCertificate(pki *maupuv1beta1.VaultSecretSpecPKI, vClient *vapi.Client, mount string, req nmvault.CertificateRequest, currentKey []byte) (*nmvault.Certificate, error) {
+	reqLogger := log.WithValues("func", "signCertificate")
+
+	var key crypto.Signer
+	var keyPEM []byte
+	if pki.PrivateKey.RotationPolicy == KeyRotationPolicyNever && len(currentKey) > 0 {
+		if k, err := nmvault.ParsePrivateKey(currentKey); err == nil && nmvault.PrivateKeyMatches(k, pki.PrivateKey.Algorithm, pki.PrivateKey.Size) {
+			key, keyPEM = k, currentKey
+		}
+	}
+	if key == nil {
+		reqLogger.Info("Generating private key", "Algorithm", pki.PrivateKey.Algorithm, "Size", pki.PrivateKey.Size)
+		var err error
+		if key, keyPEM, err = nmvault.GeneratePrivateKey(pki.PrivateKey.Algorithm, pki.PrivateKey.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	csr, err := nmvault.CreateCertificateRequest(key, req)
+	if err != nil {
+		return nil, err
+	}
+
+	reqLogger.Info("Signing certificate", "Mount", mount, "Role", pki.Role, "CommonName", pki.CommonName)
+	signed, err := nmvault.SignCertificate(vClient, mount, pki.Role, req, csr)
+	if err != nil {
+		return nil, err
+	}
+	signed.PrivateKey = string(keyPEM)
+
+	return signed, nil
+}
+
+// parseCertificate parses the first certificate of a PEM encoded chain
+func parseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("No PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// privateKeyMatches checks whether the current private key is set and, in sign mode, has the configured algorithm and size
+func privateKeyMatches(data []byte, pki *maupuv1beta1.VaultSecretSpecPKI) bool {
+	if len(data) == 0 {
+		return false
+	}
+	if pki.Mode != PKIModeSign {
+		return true
+	}
+
+	key, err := nmvault.ParsePrivateKey(data)
+	return err == nil && nmvault.PrivateKeyMatches(key, pki.PrivateKey.Algorithm, pki.PrivateKey.Size)
+}
+
+// certificateMatches checks whether a certificate has the common name and, at least, the subject alternative names of the spec
+func certificateMatches(cert *x509.Certificate, pki *maupuv1beta1.VaultSecretSpecPKI) bool {
+	if cert.Subject.CommonName != pki.CommonName {
+		return false
+	}
+
+	names := make(map[string]bool)
+	for _, name := range cert.DNSNames {
+		names[name] = true
+	}
+	for _, email := range cert.EmailAddresses {
+		names[email] = true
+	}
+	for _, ip := range cert.IPAddresses {
+		names[ip.String()] = true
+	}
+	for _, uri := range cert.URIs {
+		names[uri.String()] = true
+	}
+
+	for _, list := range [][]string{pki.AltNames, pki.IPSANs, pki.URISANs} {
+		for _, name := range list {
+			if !names[name] {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// pkiSpecHash returns the hash of the fields of the pki spec the certificate is issued from
+// The certificate is issued again when they change
+func pkiSpecHash(pki *maupuv1beta1.VaultSecretSpecPKI) string {
+	data, _ := json.Marshal(struct {
+		Mount, Role, CommonName   string
+		AltNames, IPSANs, URISANs []string
+		TTL                       string
+	}{pki.Mount, pki.Role, pki.CommonName, pki.AltNames, pki.IPSANs, pki.URISANs, pki.TTL.Duration.String()})
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+// certificateStatus returns the status of a certificate
+func certificateStatus(cert *x509.Certificate, renewAfterPercent int) *maupuv1beta1.VaultSecretStatusCertificate {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	notAfter := metav1.NewTime(cert.NotAfter)
+	renewalTime := metav1.NewTime(cert.NotBefore.Add(lifetime * time.Duration(renewAfterPercent) / 100).Truncate(time.Second))
+
+	return &maupuv1beta1.VaultSecretStatusCertificate{
+		SerialNumber: formatSerialNumber(cert.SerialNumber.Bytes()),
+		NotAfter:     &notAfter,
+		RenewalTime:  &renewalTime,
+	}
+}
+
+// formatSerialNumber formats a serial number the way vault does (colon separated hexadecimal bytes)
+func formatSerialNumber(serial []byte) string {
+	parts := make([]string, 0, len(serial))
+	for _, b := range serial {
+		parts = append(parts, fmt.Sprintf("%02x", b))
+	}
+	return strings.Join(parts, ":")
+}
@@ -0,0 +1,419 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	vapi "github.com/hashicorp/vault/api"
+	maupuv1beta1 "github.com/nmaupu/vault-secret/api/v1beta1"
+	nmvault "github.com/nmaupu/vault-secret/pkg/vault"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// testCA is a certificate authority signing the certificates returned by a pkiStub
+type testCA struct {
+	cert   *x509.Certificate
+	key    crypto.Signer
+	pem    string
+	serial int64
+}
+
+// newTestCA creates a self-signed testCA
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() err=%v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() err=%v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, serial: 1, pem: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))}
+}
+
+// sign returns a PEM encoded certificate for the public key, valid from an hour ago for lifetime
+func (ca *testCA) sign(t *testing.T, pub crypto.PublicKey, template *x509.Certificate, lifetime time.Duration) string {
+	template.SerialNumber = big.NewInt(atomic.AddInt64(&ca.serial, 1))
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = template.NotBefore.Add(lifetime)
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, pub, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() err=%v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// pkiStub is a fake vault PKI secrets engine mounted on pki, issuing and signing certificates valid for 2 hours
+type pkiStub struct {
+	*httptest.Server
+	ca     *testCA
+	issued int64
+}
+
+// newPKIStub starts a pkiStub, it has to be closed
+func newPKIStub(t *testing.T) *pkiStub {
+	s := &pkiStub{ca: newTestCA(t)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var body map[string]string
+		json.NewDecoder(req.Body).Decode(&body)
+
+		template := &x509.Certificate{Subject: pkix.Name{CommonName: body["common_name"]}}
+		for _, name := range strings.Split(body["alt_names"], ",") {
+			if name != "" {
+				template.DNSNames = append(template.DNSNames, name)
+			}
+		}
+
+		data := map[string]interface{}{"issuing_ca": s.ca.pem, "ca_chain": []string{s.ca.pem}}
+		switch req.Method + " " + req.URL.Path {
+		case "PUT /v1/pki/issue/web":
+			key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			der, _ := x509.MarshalECPrivateKey(key)
+			data["private_key"] = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+			data["certificate"] = s.ca.sign(t, key.Public(), template, 2*time.Hour)
+		case "PUT /v1/pki/sign/web":
+			block, _ := pem.Decode([]byte(body["csr"]))
+			if block == nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil || csr.CheckSignature() != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data["certificate"] = s.ca.sign(t, csr.PublicKey, template, 2*time.Hour)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		atomic.AddInt64(&s.issued, 1)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+	}))
+	return s
+}
+
+// client returns a vault client connected to the stub
+func (s *pkiStub) client(t *testing.T) *vapi.Client {
+	config := vapi.DefaultConfig()
+	config.Address = s.URL
+	config.MaxRetries = 0
+	vclient, err := vapi.NewClient(config)
+	if err != nil {
+		t.Fatalf("NewClient() err=%v", err)
+	}
+	vclient.SetToken("token")
+	return vclient
+}
+
+func TestCertificateMatches(t *testing.T) {
+	uri, _ := url.Parse("spiffe://example.com/app")
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "app.example.com"},
+		DNSNames:       []string{"app.example.com", "app"},
+		EmailAddresses: []string{"admin@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("10.0.0.1")},
+		URIs:           []*url.URL{uri},
+	}
+
+	tests := []struct {
+		name string
+		pki  maupuv1beta1.VaultSecretSpecPKI
+		want bool
+	}{
+		{name: "same names", want: true, pki: maupuv1beta1.VaultSecretSpecPKI{CommonName: "app.example.com",
+			AltNames: []string{"app", "admin@example.com"}, IPSANs: []string{"10.0.0.1"}, URISANs: []string{"spiffe://example.com/app"}}},
+		{name: "subset of the names", want: true, pki: maupuv1beta1.VaultSecretSpecPKI{CommonName: "app.example.com", AltNames: []string{"app"}}},
+		{name: "other common name", want: false, pki: maupuv1beta1.VaultSecretSpecPKI{CommonName: "api.example.com"}},
+		{name: "missing DNS name", want: false, pki: maupuv1beta1.VaultSecretSpecPKI{CommonName: "app.example.com", AltNames: []string{"api"}}},
+		{name: "missing IP address", want: false, pki: maupuv1beta1.VaultSecretSpecPKI{CommonName: "app.example.com", IPSANs: []string{"10.0.0.2"}}},
+		{name: "missing URI", want: false, pki: maupuv1beta1.VaultSecretSpecPKI{CommonName: "app.example.com", URISANs: []string{"spiffe://example.com/api"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := certificateMatches(cert, &tt.pki); got != tt.want {
+				t.Errorf("certificateMatches()=%t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPKISpecHash(t *testing.T) {
+	base := maupuv1beta1.VaultSecretSpecPKI{Mount: "pki", Role: "web", CommonName: "app.example.com", AltNames: []string{"app"}}
+
+	tests := []struct {
+		name       string
+		update     func(pki *maupuv1beta1.VaultSecretSpecPKI)
+		wantChange bool
+	}{
+		{name: "mount", update: func(pki *maupuv1beta1.VaultSecretSpecPKI) { pki.Mount = "pki-int" }, wantChange: true},
+		{name: "role", update: func(pki *maupuv1beta1.VaultSecretSpecPKI) { pki.Role = "api" }, wantChange: true},
+		{name: "common name", update: func(pki *maupuv1beta1.VaultSecretSpecPKI) { pki.CommonName = "api.example.com" }, wantChange: true},
+		{name: "alt names", update: func(pki *maupuv1beta1.VaultSecretSpecPKI) { pki.AltNames = nil }, wantChange: true},
+		{name: "ip sans", update: func(pki *maupuv1beta1.VaultSecretSpecPKI) { pki.IPSANs = []string{"10.0.0.1"} }, wantChange: true},
+		{name: "uri sans", update: func(pki *maupuv1beta1.VaultSecretSpecPKI) { pki.URISANs = []string{"spiffe://example.com/app"} }, wantChange: true},
+		{name: "ttl", update: func(pki *maupuv1beta1.VaultSecretSpecPKI) { pki.TTL = metav1.Duration{Duration: time.Hour} }, wantChange: true},
+		{name: "renewal percentage", update: func(pki *maupuv1beta1.VaultSecretSpecPKI) { pki.RenewAfterPercent = 50 }, wantChange: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updated := base
+			tt.update(&updated)
+			if changed := pkiSpecHash(&updated) != pkiSpecHash(&base); changed != tt.wantChange {
+				t.Errorf("hash changed=%t, want %t", changed, tt.wantChange)
+			}
+		})
+	}
+}
+
+func TestFormatSerialNumber(t *testing.T) {
+	tests := []struct {
+		serial []byte
+		want   string
+	}{
+		{serial: []byte{0x01}, want: "01"},
+		{serial: []byte{0x0a, 0xbc, 0x00, 0xff}, want: "0a:bc:00:ff"},
+		{serial: nil, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := formatSerialNumber(tt.serial); got != tt.want {
+				t.Errorf("formatSerialNumber()=%s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCertificateIssue(t *testing.T) {
+	base := maupuv1beta1.VaultSecretSpecPKI{Role: "web", CommonName: "app.example.com", AltNames: []string{"app"}}
+
+	tests := []struct {
+		name       string
+		update     func(pki *maupuv1beta1.VaultSecretSpecPKI, annotations map[string]string)
+		wantIssued bool
+		wantErr    bool
+	}{
+		{name: "current certificate reused", wantIssued: false,
+			update: func(pki *maupuv1beta1.VaultSecretSpecPKI, annotations map[string]string) {}},
+		{name: "issued again when the spec changes", wantIssued: true,
+			update: func(pki *maupuv1beta1.VaultSecretSpecPKI, annotations map[string]string) {
+				pki.TTL = metav1.Duration{Duration: time.Hour}
+			}},
+		{name: "issued again when a name is added", wantIssued: true,
+			update: func(pki *maupuv1beta1.VaultSecretSpecPKI, annotations map[string]string) {
+				pki.AltNames = []string{"app", "api"}
+			}},
+		{name: "issued again when the renewal time is reached", wantIssued: true,
+			update: func(pki *maupuv1beta1.VaultSecretSpecPKI, annotations map[string]string) {
+				pki.RenewAfterPercent = 40
+			}},
+		{name: "issued again without hash annotation", wantIssued: true,
+			update: func(pki *maupuv1beta1.VaultSecretSpecPKI, annotations map[string]string) {
+				delete(annotations, PKISpecHashAnnotation)
+			}},
+		{name: "issued again when the key was produced by another mode", wantIssued: true,
+			update: func(pki *maupuv1beta1.VaultSecretSpecPKI, annotations map[string]string) {
+				annotations[PKIModeAnnotation] = PKIModeSign
+			}},
+		{name: "role required", wantErr: true,
+			update: func(pki *maupuv1beta1.VaultSecretSpecPKI, annotations map[string]string) {
+				pki.Role = ""
+				pki.TTL = metav1.Duration{Duration: time.Hour}
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newPKIStub(t)
+			defer stub.Close()
+			vclient := stub.client(t)
+
+			pki := base
+			current, annotations, status := readCertificate(&pki, vclient, nil, nil)
+			if status.Error != "" {
+				t.Fatalf("readCertificate() status=%+v", status)
+			}
+			if len(current[corev1.TLSPrivateKeyKey]) == 0 || string(current[TLSCAKey]) != stub.ca.pem {
+				t.Errorf("readCertificate()=%v, want a private key and the CA chain", current)
+			}
+
+			tt.update(&pki, annotations)
+			data, _, status := readCertificate(&pki, vclient, current, annotations)
+			if (status.Error != "") != tt.wantErr {
+				t.Fatalf("readCertificate() status=%+v, wantErr %t", status, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if issued := atomic.LoadInt64(&stub.issued) == 2; issued != tt.wantIssued {
+				t.Errorf("issued=%t, want %t", issued, tt.wantIssued)
+			}
+			if reused := string(data[corev1.TLSCertKey]) == string(current[corev1.TLSCertKey]); reused == tt.wantIssued {
+				t.Errorf("certificate reused=%t, want %t", reused, !tt.wantIssued)
+			}
+
+			cert, err := parseCertificate(data[corev1.TLSCertKey])
+			if err != nil {
+				t.Fatalf("parseCertificate() err=%v", err)
+			}
+			if !certificateMatches(cert, &pki) {
+				t.Errorf("certificate CN=%s DNSNames=%v does not match the spec", cert.Subject.CommonName, cert.DNSNames)
+			}
+			if !strings.HasSuffix(string(data[corev1.TLSCertKey]), stub.ca.pem) {
+				t.Errorf("%s does not end with the CA chain", corev1.TLSCertKey)
+			}
+		})
+	}
+}
+
+func TestPrivateKeyMatches(t *testing.T) {
+	_, rsaKey, _ := nmvault.GeneratePrivateKey(nmvault.KeyAlgorithmRSA, 0)
+	_, ecKey, _ := nmvault.GeneratePrivateKey(nmvault.KeyAlgorithmECDSA, 0)
+
+	tests := []struct {
+		name string
+		data []byte
+		pki  maupuv1beta1.VaultSecretSpecPKI
+		want bool
+	}{
+		{name: "issue mode, any key", data: rsaKey, want: true,
+			pki: maupuv1beta1.VaultSecretSpecPKI{PrivateKey: maupuv1beta1.PKIPrivateKey{Algorithm: nmvault.KeyAlgorithmECDSA}}},
+		{name: "issue mode, no key", data: nil, want: false},
+		{name: "sign mode, same algorithm", data: ecKey, want: true,
+			pki: maupuv1beta1.VaultSecretSpecPKI{Mode: PKIModeSign, PrivateKey: maupuv1beta1.PKIPrivateKey{Algorithm: nmvault.KeyAlgorithmECDSA}}},
+		{name: "sign mode, other algorithm", data: rsaKey, want: false,
+			pki: maupuv1beta1.VaultSecretSpecPKI{Mode: PKIModeSign, PrivateKey: maupuv1beta1.PKIPrivateKey{Algorithm: nmvault.KeyAlgorithmECDSA}}},
+		{name: "sign mode, other size", data: ecKey, want: false,
+			pki: maupuv1beta1.VaultSecretSpecPKI{Mode: PKIModeSign, PrivateKey: maupuv1beta1.PKIPrivateKey{Algorithm: nmvault.KeyAlgorithmECDSA, Size: 384}}},
+		{name: "sign mode, invalid key", data: []byte("key"), want: false,
+			pki: maupuv1beta1.VaultSecretSpecPKI{Mode: PKIModeSign}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := privateKeyMatches(tt.data, &tt.pki); got != tt.want {
+				t.Errorf("privateKeyMatches()=%t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCertificateSign(t *testing.T) {
+	tests := []struct {
+		name        string
+		currentMode string
+		privateKey  maupuv1beta1.PKIPrivateKey
+		update      func(pki *maupuv1beta1.VaultSecretSpecPKI)
+		wantKeyKept bool
+	}{
+		{name: "new key on renewal", privateKey: maupuv1beta1.PKIPrivateKey{Algorithm: nmvault.KeyAlgorithmECDSA},
+			wantKeyKept: false},
+		{name: "key kept on renewal", privateKey: maupuv1beta1.PKIPrivateKey{Algorithm: nmvault.KeyAlgorithmECDSA, RotationPolicy: KeyRotationPolicyNever},
+			wantKeyKept: true},
+		{name: "new key when the algorithm changes", privateKey: maupuv1beta1.PKIPrivateKey{Algorithm: nmvault.KeyAlgorithmECDSA, RotationPolicy: KeyRotationPolicyNever},
+			update:      func(pki *maupuv1beta1.VaultSecretSpecPKI) { pki.PrivateKey.Algorithm = nmvault.KeyAlgorithmEd25519 },
+			wantKeyKept: false},
+		{name: "key generated by vault never kept", currentMode: PKIModeIssue, privateKey: maupuv1beta1.PKIPrivateKey{RotationPolicy: KeyRotationPolicyNever},
+			wantKeyKept: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newPKIStub(t)
+			defer stub.Close()
+			vclient := stub.client(t)
+
+			// The current certificate is renewed as 50% of its lifetime has elapsed
+			pki := maupuv1beta1.VaultSecretSpecPKI{Role: "web", CommonName: "app.example.com", Mode: PKIModeSign, PrivateKey: tt.privateKey}
+			if tt.currentMode != "" {
+				pki.Mode = tt.currentMode
+			}
+			current, annotations, status := readCertificate(&pki, vclient, nil, nil)
+			if status.Error != "" {
+				t.Fatalf("readCertificate() status=%+v", status)
+			}
+
+			pki.Mode = PKIModeSign
+			pki.RenewAfterPercent = 40
+			if tt.update != nil {
+				tt.update(&pki)
+			}
+			data, annotations, status := readCertificate(&pki, vclient, current, annotations)
+			if status.Error != "" {
+				t.Fatalf("readCertificate() status=%+v", status)
+			}
+			if atomic.LoadInt64(&stub.issued) != 2 {
+				t.Errorf("certificates=%d, want 2", atomic.LoadInt64(&stub.issued))
+			}
+			if annotations[PKIModeAnnotation] != PKIModeSign {
+				t.Errorf("%s=%s, want %s", PKIModeAnnotation, annotations[PKIModeAnnotation], PKIModeSign)
+			}
+
+			if kept := string(data[corev1.TLSPrivateKeyKey]) == string(current[corev1.TLSPrivateKeyKey]); kept != tt.wantKeyKept {
+				t.Errorf("private key kept=%t, want %t", kept, tt.wantKeyKept)
+			}
+			key, err := nmvault.ParsePrivateKey(data[corev1.TLSPrivateKeyKey])
+			if err != nil {
+				t.Fatalf("ParsePrivateKey() err=%v", err)
+			}
+			if !nmvault.PrivateKeyMatches(key, pki.PrivateKey.Algorithm, pki.PrivateKey.Size) {
+				t.Errorf("private key %T does not match %+v", key, pki.PrivateKey)
+			}
+			cert, err := parseCertificate(data[corev1.TLSCertKey])
+			if err != nil {
+				t.Fatalf("parseCertificate() err=%v", err)
+			}
+			if !reflect.DeepEqual(cert.PublicKey, key.Public()) {
+				t.Errorf("certificate is not signed for the private key")
+			}
+		})
+	}
+}
@@ -20,14 +20,17 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	goruntime "runtime"
 	"strings"
 
 	vaultsecret "github.com/nmaupu/vault-secret/controllers"
+	nmvault "github.com/nmaupu/vault-secret/pkg/vault"
 	appVersion "github.com/nmaupu/vault-secret/version"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/kubernetes"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -35,8 +38,11 @@ import (
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/yaml"
 
 	maupuv1beta1 "github.com/nmaupu/vault-secret/api/v1beta1"
+	"github.com/nmaupu/vault-secret/pkg/k8sutils"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -80,12 +86,54 @@ func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
 	var labels stringArrayFlag
+	var vaultConfigFile, vaultAddr, vaultNamespace, vaultCACertFile, vaultConsistency string
+	var identityPolicyFile, identityMode, operatorServiceAccount string
+	transportConfig := nmvault.DefaultTransportConfig()
 
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.Var(&labels, "filter-label", "Process only VaultSecret custom resources containing the given labels")
+	flag.StringVar(&vaultConfigFile, "vault-config", "",
+		"YAML file containing the default vault configuration used for the fields not set in VaultSecret custom resources. "+
+			"Same format as the config section of a VaultSecret.")
+	flag.StringVar(&vaultAddr, "vault-addr", "", "Default vault address, overrides the one from --vault-config")
+	flag.StringVar(&vaultNamespace, "vault-namespace", "", "Default vault namespace, overrides the one from --vault-config")
+	flag.StringVar(&vaultConsistency, "vault-consistency", "",
+		"Default consistency mode of the reads served by vault performance standby nodes (forwardActive, retry or bestEffort), overrides the one from --vault-config")
+	flag.StringVar(&vaultCACertFile, "vault-ca-cert", "", "PEM encoded CA bundle file used to verify the vault server's certificate")
+	flag.StringVar(&identityPolicyFile, "identity-policy", "",
+		"YAML file containing the policy selecting the service account used by the Kubernetes auth method")
+	flag.StringVar(&identityMode, "identity-mode", "",
+		"Service account used by the Kubernetes auth method (namespace, operator or mapping), overrides the one from --identity-policy")
+	flag.StringVar(&operatorServiceAccount, "operator-service-account", "",
+		"Name of the operator's service account, used with the operator identity mode")
+
+	flag.DurationVar(&transportConfig.Timeout, "vault-timeout", transportConfig.Timeout, "Timeout of a request to vault")
+	flag.DurationVar(&transportConfig.DialTimeout, "vault-dial-timeout", transportConfig.DialTimeout, "Timeout of a connection to vault")
+	flag.DurationVar(&transportConfig.TLSHandshakeTimeout, "vault-tls-handshake-timeout", transportConfig.TLSHandshakeTimeout,
+		"Timeout of a TLS handshake with vault")
+	flag.DurationVar(&transportConfig.KeepAlive, "vault-keep-alive", transportConfig.KeepAlive,
+		"Interval between keep-alive probes of the connections to vault, a negative value disables keep-alives")
+	flag.DurationVar(&transportConfig.IdleConnTimeout, "vault-idle-conn-timeout", transportConfig.IdleConnTimeout,
+		"Duration after which an idle connection to vault is closed")
+	flag.IntVar(&transportConfig.MaxIdleConns, "vault-max-idle-conns", transportConfig.MaxIdleConns,
+		"Maximum number of idle connections to vault, per TLS configuration")
+	flag.IntVar(&transportConfig.MaxIdleConnsPerHost, "vault-max-idle-conns-per-host", transportConfig.MaxIdleConnsPerHost,
+		"Maximum number of idle connections to a vault server, per TLS configuration")
+	flag.StringVar(&transportConfig.ProxyURL, "vault-proxy", "",
+		"URL of the HTTP proxy used to connect to vault, proxy env vars (HTTPS_PROXY, NO_PROXY, etc.) are used if not set")
+	flag.IntVar(&transportConfig.MaxRetries, "vault-max-retries", transportConfig.MaxRetries,
+		"Maximum number of retries of a vault request failing with a transient error (429, or connection error and 5xx for reads)")
+	flag.DurationVar(&transportConfig.RetryWaitMin, "vault-retry-wait-min", transportConfig.RetryWaitMin,
+		"Minimum time to wait before retrying a vault request, doubled on each retry")
+	flag.DurationVar(&transportConfig.RetryWaitMax, "vault-retry-wait-max", transportConfig.RetryWaitMax,
+		"Maximum time to wait before retrying a vault request")
+	flag.Float64Var(&transportConfig.RateLimit, "vault-rate-limit", 0,
+		"Maximum number of requests per second to a vault server, shared by all VaultSecret custom resources (0 means no limit)")
+	flag.IntVar(&transportConfig.RateLimitBurst, "vault-rate-limit-burst", transportConfig.RateLimitBurst,
+		"Number of requests which can be sent at once to a vault server above --vault-rate-limit")
 
 	flag.Parse()
 
@@ -108,6 +156,58 @@ func main() {
 		}
 	}
 
+	// Default vault configuration
+	defaultVaultConfig, err := loadDefaultVaultConfig(vaultConfigFile)
+	if err != nil {
+		setupLog.Error(err, "unable to load default vault configuration")
+		os.Exit(1)
+	}
+	if vaultAddr != "" {
+		defaultVaultConfig.Addr = vaultAddr
+	}
+	if vaultNamespace != "" {
+		defaultVaultConfig.Namespace = vaultNamespace
+	}
+	if vaultConsistency != "" {
+		defaultVaultConfig.Consistency = vaultConsistency
+	}
+	switch nmvault.ConsistencyMode(defaultVaultConfig.Consistency) {
+	case "", nmvault.ConsistencyBestEffort, nmvault.ConsistencyForwardActive, nmvault.ConsistencyRetry:
+	default:
+		setupLog.Error(fmt.Errorf("unknown consistency mode %s", defaultVaultConfig.Consistency), "invalid default vault configuration")
+		os.Exit(1)
+	}
+	var vaultCACert []byte
+	if vaultCACertFile != "" {
+		if vaultCACert, err = ioutil.ReadFile(vaultCACertFile); err != nil {
+			setupLog.Error(err, "unable to read vault CA certificate")
+			os.Exit(1)
+		}
+	}
+
+	// Identity policy for the Kubernetes auth method
+	identityPolicy, err := loadIdentityPolicy(identityPolicyFile)
+	if err != nil {
+		setupLog.Error(err, "unable to load identity policy")
+		os.Exit(1)
+	}
+	if identityMode != "" {
+		identityPolicy.Mode = k8sutils.IdentityMode(identityMode)
+	}
+	if operatorServiceAccount != "" {
+		identityPolicy.OperatorServiceAccount.Name = operatorServiceAccount
+	}
+	if identityPolicy.Mode == k8sutils.IdentityModeOperator && identityPolicy.OperatorServiceAccount.Namespace == "" {
+		if identityPolicy.OperatorServiceAccount.Namespace, err = k8sutils.GetOperatorNamespace(); err != nil {
+			setupLog.Error(err, "unable to configure the operator identity mode")
+			os.Exit(1)
+		}
+	}
+	if err := identityPolicy.Validate(); err != nil {
+		setupLog.Error(err, "invalid identity policy")
+		os.Exit(1)
+	}
+
 	// Get namespace to watch from WATCH_NAMESPACE environment variable
 	// If set, use it. Otherwise, try WATCH_MULTINAMESPACES environment variable
 	// If not set, use cluster wide configuration
@@ -149,11 +249,37 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Clientset used for the requests the manager's client does not support
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		setupLog.Error(err, "unable to create kubernetes clientset")
+		os.Exit(1)
+	}
+
+	// Tokens are revoked when the manager stops, except the ones which created leases still in use
+	leaseManager := nmvault.NewLeaseManager()
+	tokenManager := nmvault.NewTokenManager()
+	tokenManager.SetLeaseManager(leaseManager)
+
+	// Vault clients share their connections, statistics are exposed on the metrics endpoint
+	clientFactory := nmvault.NewClientFactory(transportConfig)
+	if err := metrics.Registry.Register(clientFactory); err != nil {
+		setupLog.Error(err, "unable to register vault client metrics")
+	}
+
 	if err = (&vaultsecret.VaultSecretReconciler{
-		Client:       mgr.GetClient(),
-		Log:          ctrl.Log.WithName("controllers").WithName("VaultSecret"),
-		Scheme:       mgr.GetScheme(),
-		LabelsFilter: labelsFilter,
+		Client:         mgr.GetClient(),
+		Clientset:      clientset,
+		Recorder:       mgr.GetEventRecorderFor(vaultsecret.OperatorAppName),
+		TokenManager:   tokenManager,
+		LeaseManager:   leaseManager,
+		Log:            ctrl.Log.WithName("controllers").WithName("VaultSecret"),
+		Scheme:         mgr.GetScheme(),
+		LabelsFilter:   labelsFilter,
+		DefaultConfig:  defaultVaultConfig,
+		DefaultCACert:  vaultCACert,
+		IdentityPolicy: identityPolicy,
+		ClientFactory:  clientFactory,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "VaultSecret")
 		os.Exit(1)
@@ -161,12 +287,57 @@ func main() {
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctrl.SetupSignalHandler())
+
+	setupLog.Info("revoking vault tokens")
+	tokenManager.RevokeAll()
+
+	if err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
 
+// loadDefaultVaultConfig loads the default vault configuration from a YAML file
+// An empty configuration is returned if no file is provided
+func loadDefaultVaultConfig(file string) (*maupuv1beta1.VaultSecretSpecConfig, error) {
+	config := &maupuv1beta1.VaultSecretSpecConfig{}
+	if file == "" {
+		return config, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, fmt.Errorf("unable to parse %s, err=%v", file, err)
+	}
+
+	return config, nil
+}
+
+// loadIdentityPolicy loads the identity policy from a YAML file
+// A policy using the custom resources' namespace is returned if no file is provided
+func loadIdentityPolicy(file string) (*k8sutils.IdentityPolicy, error) {
+	policy := &k8sutils.IdentityPolicy{}
+	if file == "" {
+		return policy, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("unable to parse %s, err=%v", file, err)
+	}
+
+	return policy, nil
+}
+
 // GetWatchMultiNamespaces returns the namespaces list the operator should be watching for changes
 // Very similar to WATCH_NAMESPACE but for multiple namespaces
 func getWatchMultiNamespaces() ([]string, error) {
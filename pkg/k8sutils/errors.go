@@ -0,0 +1,93 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sutils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ReasonServiceAccountNotFound is the reason of a ServiceAccountNotFoundError
+	ReasonServiceAccountNotFound = "ServiceAccountNotFound"
+	// ReasonNoValidServiceAccountToken is the reason of a NoValidServiceAccountTokenError
+	ReasonNoValidServiceAccountToken = "NoValidServiceAccountToken"
+	// ReasonSecretKeyNotFound is the reason of a SecretKeyNotFoundError
+	ReasonSecretKeyNotFound = "SecretKeyNotFound"
+)
+
+// ServiceAccountNotFoundError represents an error raised when a service account does not exist
+type ServiceAccountNotFoundError struct {
+	Namespace, Name string
+}
+
+// Error
+func (e *ServiceAccountNotFoundError) Error() string {
+	return fmt.Sprintf("Service account %s/%s not found", e.Namespace, e.Name)
+}
+
+// Reason returns a machine-readable reason of the error
+func (e *ServiceAccountNotFoundError) Reason() string {
+	return ReasonServiceAccountNotFound
+}
+
+// NoValidServiceAccountTokenError represents an error raised when no secret of a service account
+// contains a usable token
+type NoValidServiceAccountTokenError struct {
+	Namespace, Name string
+	// Rejected lists why each candidate secret has been rejected
+	Rejected []string
+}
+
+// Error
+func (e *NoValidServiceAccountTokenError) Error() string {
+	if len(e.Rejected) == 0 {
+		return fmt.Sprintf("No token secret associated with the service account %s/%s", e.Namespace, e.Name)
+	}
+	return fmt.Sprintf("No valid token secret associated with the service account %s/%s, rejected=[%s]",
+		e.Namespace, e.Name, strings.Join(e.Rejected, "; "))
+}
+
+// Reason returns a machine-readable reason of the error
+func (e *NoValidServiceAccountTokenError) Reason() string {
+	return ReasonNoValidServiceAccountToken
+}
+
+// SecretKeyNotFoundError represents an error raised when a key does not exist in a secret
+type SecretKeyNotFoundError struct {
+	Namespace, Name, Key string
+}
+
+// Error
+func (e *SecretKeyNotFoundError) Error() string {
+	return fmt.Sprintf("Key %s does not exist in the secret %s/%s", e.Key, e.Namespace, e.Name)
+}
+
+// Reason returns a machine-readable reason of the error
+func (e *SecretKeyNotFoundError) Reason() string {
+	return ReasonSecretKeyNotFound
+}
+
+// ErrorReason returns the machine-readable reason of an error, empty if unknown
+func ErrorReason(err error) string {
+	var reasoner interface{ Reason() string }
+	if errors.As(err, &reasoner) {
+		return reasoner.Reason()
+	}
+	return ""
+}
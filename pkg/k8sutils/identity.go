@@ -0,0 +1,171 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sutils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// IdentityMode selects which service account is used to authenticate to vault
+type IdentityMode string
+
+const (
+	// IdentityModeNamespace uses a service account located in the custom resource's namespace
+	IdentityModeNamespace IdentityMode = "namespace"
+	// IdentityModeOperator uses the operator's own service account
+	IdentityModeOperator IdentityMode = "operator"
+	// IdentityModeMapping uses the service account mapped to the custom resource's namespace
+	IdentityModeMapping IdentityMode = "mapping"
+
+	// DefaultServiceAccount is the service account used if none is specified
+	DefaultServiceAccount = "default"
+	// AllServiceAccounts allows all the service accounts of a namespace in an allowlist
+	AllServiceAccounts = "*"
+
+	// PodNamespaceEnvVar is the env var containing the operator's namespace
+	PodNamespaceEnvVar = "POD_NAMESPACE"
+	// inClusterNamespaceFile is the file containing the operator's namespace when running in a pod
+	inClusterNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// ServiceAccountRef is a reference to a k8s' service account
+type ServiceAccountRef struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+}
+
+// String returns the namespaced name of the service account
+func (s ServiceAccountRef) String() string {
+	return s.Namespace + "/" + s.Name
+}
+
+// Subject returns the subject of the tokens issued for the service account
+func (s ServiceAccountRef) Subject() string {
+	return "system:serviceaccount:" + s.Namespace + ":" + s.Name
+}
+
+// IdentityPolicy is the operator-level policy selecting the service account used by the Kubernetes auth method
+type IdentityPolicy struct {
+	// Mode selects the service account to use, defaults to IdentityModeNamespace
+	Mode IdentityMode `json:"mode,omitempty"`
+	// OperatorServiceAccount is the operator's own service account, used with IdentityModeOperator
+	OperatorServiceAccount ServiceAccountRef `json:"operatorServiceAccount,omitempty"`
+	// Mapping maps the namespaces of the custom resources to service accounts, used with IdentityModeMapping
+	Mapping map[string]ServiceAccountRef `json:"mapping,omitempty"`
+	// AllowedServiceAccounts lists, for each namespace, the service accounts custom resources can name
+	// Used with IdentityModeNamespace, all service accounts are allowed if empty
+	AllowedServiceAccounts map[string][]string `json:"allowedServiceAccounts,omitempty"`
+}
+
+// ServiceAccount returns the service account to use for a custom resource located in namespace ns
+// and naming the service account saName (may be empty)
+func (p *IdentityPolicy) ServiceAccount(ns, saName string) (ServiceAccountRef, error) {
+	mode := IdentityModeNamespace
+	if p != nil && p.Mode != "" {
+		mode = p.Mode
+	}
+
+	switch mode {
+	case IdentityModeNamespace:
+		if saName == "" {
+			saName = DefaultServiceAccount
+		}
+		if !p.allowed(ns, saName) {
+			return ServiceAccountRef{}, fmt.Errorf("Service account %s/%s is not allowed by the operator's identity policy", ns, saName)
+		}
+		return ServiceAccountRef{Namespace: ns, Name: saName}, nil
+	case IdentityModeOperator:
+		if p.OperatorServiceAccount.Name == "" || p.OperatorServiceAccount.Namespace == "" {
+			return ServiceAccountRef{}, fmt.Errorf("Operator's service account is not configured")
+		}
+		return p.OperatorServiceAccount, nil
+	case IdentityModeMapping:
+		sa, found := p.Mapping[ns]
+		if !found {
+			return ServiceAccountRef{}, fmt.Errorf("No service account mapped to namespace %s in the operator's identity policy", ns)
+		}
+		return sa, nil
+	}
+
+	return ServiceAccountRef{}, fmt.Errorf("Unknown identity mode %s, please choose between %s, %s or %s",
+		mode, IdentityModeNamespace, IdentityModeOperator, IdentityModeMapping)
+}
+
+// SharedIdentity checks whether the service account is selected by the operator (operator and mapping modes)
+// instead of being named by the custom resource
+func (p *IdentityPolicy) SharedIdentity() bool {
+	return p != nil && (p.Mode == IdentityModeOperator || p.Mode == IdentityModeMapping)
+}
+
+// Validate checks the policy's mode and the service accounts it requires
+func (p *IdentityPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+
+	switch p.Mode {
+	case "", IdentityModeNamespace:
+		return nil
+	case IdentityModeOperator:
+		if p.OperatorServiceAccount.Name == "" || p.OperatorServiceAccount.Namespace == "" {
+			return fmt.Errorf("Operator's service account is not configured, please set --operator-service-account")
+		}
+		return nil
+	case IdentityModeMapping:
+		for ns, sa := range p.Mapping {
+			if sa.Name == "" || sa.Namespace == "" {
+				return fmt.Errorf("Invalid service account mapped to namespace %s, name and namespace are required", ns)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown identity mode %s, please choose between %s, %s or %s",
+		p.Mode, IdentityModeNamespace, IdentityModeOperator, IdentityModeMapping)
+}
+
+// allowed checks whether a custom resource located in namespace ns can name the service account saName
+func (p *IdentityPolicy) allowed(ns, saName string) bool {
+	if p == nil || len(p.AllowedServiceAccounts) == 0 {
+		return true
+	}
+
+	for _, allowed := range p.AllowedServiceAccounts[ns] {
+		if allowed == saName || allowed == AllServiceAccounts {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetOperatorNamespace returns the namespace the operator is running in
+func GetOperatorNamespace() (string, error) {
+	if ns := os.Getenv(PodNamespaceEnvVar); ns != "" {
+		return ns, nil
+	}
+
+	ns, err := ioutil.ReadFile(inClusterNamespaceFile)
+	if err != nil {
+		return "", fmt.Errorf("Unable to get operator's namespace, %s is not set, err=%v", PodNamespaceEnvVar, err)
+	}
+
+	return strings.TrimSpace(string(ns)), nil
+}
@@ -0,0 +1,129 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sutils
+
+import (
+	"testing"
+)
+
+func TestIdentityPolicyServiceAccount(t *testing.T) {
+	operatorSA := ServiceAccountRef{Namespace: "vault-secret", Name: "vault-secret"}
+	mappedSA := ServiceAccountRef{Namespace: "vault-identities", Name: "team-a"}
+
+	tests := []struct {
+		name    string
+		policy  *IdentityPolicy
+		ns      string
+		saName  string
+		want    ServiceAccountRef
+		wantErr bool
+	}{
+		{name: "no policy, default service account", policy: nil, ns: "team-a",
+			want: ServiceAccountRef{Namespace: "team-a", Name: DefaultServiceAccount}},
+		{name: "no policy, named service account", policy: nil, ns: "team-a", saName: "reader",
+			want: ServiceAccountRef{Namespace: "team-a", Name: "reader"}},
+		{name: "namespace mode, allowed service account", ns: "team-a", saName: "reader",
+			policy: &IdentityPolicy{Mode: IdentityModeNamespace, AllowedServiceAccounts: map[string][]string{"team-a": {"reader"}}},
+			want:   ServiceAccountRef{Namespace: "team-a", Name: "reader"}},
+		{name: "namespace mode, all service accounts allowed", ns: "team-a", saName: "writer",
+			policy: &IdentityPolicy{AllowedServiceAccounts: map[string][]string{"team-a": {AllServiceAccounts}}},
+			want:   ServiceAccountRef{Namespace: "team-a", Name: "writer"}},
+		{name: "namespace mode, service account not allowed", ns: "team-a", saName: "writer",
+			policy:  &IdentityPolicy{AllowedServiceAccounts: map[string][]string{"team-a": {"reader"}}},
+			wantErr: true},
+		{name: "namespace mode, namespace not listed", ns: "team-b", saName: "reader",
+			policy:  &IdentityPolicy{AllowedServiceAccounts: map[string][]string{"team-a": {"reader"}}},
+			wantErr: true},
+		{name: "operator mode", ns: "team-a", saName: "reader",
+			policy: &IdentityPolicy{Mode: IdentityModeOperator, OperatorServiceAccount: operatorSA},
+			want:   operatorSA},
+		{name: "operator mode, service account not configured", ns: "team-a",
+			policy:  &IdentityPolicy{Mode: IdentityModeOperator},
+			wantErr: true},
+		{name: "mapping mode", ns: "team-a", saName: "reader",
+			policy: &IdentityPolicy{Mode: IdentityModeMapping, Mapping: map[string]ServiceAccountRef{"team-a": mappedSA}},
+			want:   mappedSA},
+		{name: "mapping mode, namespace not mapped", ns: "team-b",
+			policy:  &IdentityPolicy{Mode: IdentityModeMapping, Mapping: map[string]ServiceAccountRef{"team-a": mappedSA}},
+			wantErr: true},
+		{name: "unknown mode", ns: "team-a",
+			policy:  &IdentityPolicy{Mode: "unknown"},
+			wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.policy.ServiceAccount(tt.ns, tt.saName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ServiceAccount() err=%v, wantErr %t", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ServiceAccount()=%s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentityPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  *IdentityPolicy
+		wantErr bool
+	}{
+		{name: "no policy", policy: nil},
+		{name: "default mode", policy: &IdentityPolicy{}},
+		{name: "operator mode", policy: &IdentityPolicy{Mode: IdentityModeOperator,
+			OperatorServiceAccount: ServiceAccountRef{Namespace: "vault-secret", Name: "vault-secret"}}},
+		{name: "operator mode without service account name", wantErr: true, policy: &IdentityPolicy{Mode: IdentityModeOperator,
+			OperatorServiceAccount: ServiceAccountRef{Namespace: "vault-secret"}}},
+		{name: "mapping mode", policy: &IdentityPolicy{Mode: IdentityModeMapping,
+			Mapping: map[string]ServiceAccountRef{"team-a": {Namespace: "vault-identities", Name: "team-a"}}}},
+		{name: "mapping mode with incomplete service account", wantErr: true, policy: &IdentityPolicy{Mode: IdentityModeMapping,
+			Mapping: map[string]ServiceAccountRef{"team-a": {Name: "team-a"}}}},
+		{name: "unknown mode", wantErr: true, policy: &IdentityPolicy{Mode: "namespaces"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() err=%v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestIdentityPolicySharedIdentity(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *IdentityPolicy
+		want   bool
+	}{
+		{name: "no policy", policy: nil, want: false},
+		{name: "default mode", policy: &IdentityPolicy{}, want: false},
+		{name: "namespace mode", policy: &IdentityPolicy{Mode: IdentityModeNamespace}, want: false},
+		{name: "operator mode", policy: &IdentityPolicy{Mode: IdentityModeOperator}, want: true},
+		{name: "mapping mode", policy: &IdentityPolicy{Mode: IdentityModeMapping}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.SharedIdentity(); got != tt.want {
+				t.Errorf("SharedIdentity()=%t, want %t", got, tt.want)
+			}
+		})
+	}
+}
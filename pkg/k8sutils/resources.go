@@ -18,39 +18,234 @@ package k8sutils
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"strings"
+	"time"
 
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
-// GetTokenFromSA gets the token associated to the first secret located in a k8s' service account
+// DefaultTokenExpirationSeconds is the validity duration of a token requested for a service account
+// It is also the minimum value accepted by the api server
+const DefaultTokenExpirationSeconds int64 = 600
+
+// RequestTokenForSA requests a short-lived token for a k8s' service account using the TokenRequest API
+func RequestTokenForSA(cs kubernetes.Interface, ns, saName string, audiences []string, expirationSeconds int64) (string, error) {
+	if cs == nil {
+		return "", fmt.Errorf("Cannot request a token for service account, k8s clientset is nil")
+	}
+
+	if expirationSeconds == 0 {
+		expirationSeconds = DefaultTokenExpirationSeconds
+	}
+
+	tokenRequest := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         audiences,
+			ExpirationSeconds: &expirationSeconds,
+		},
+	}
+	tokenRequest, err := cs.CoreV1().ServiceAccounts(ns).CreateToken(context.TODO(), saName, tokenRequest, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("Unable to request a token for the service account %s/%s, err=%v", ns, saName, err)
+	}
+
+	return tokenRequest.Status.Token, nil
+}
+
+// GetTokenFromSA gets a valid token from the secrets associated to a k8s' service account
+// Secrets linked to the service account are tried first, then the service account token secrets
+// annotated with the service account's name (e.g. created manually from k8s 1.24)
 func GetTokenFromSA(cli client.Client, ns, saName string) (string, error) {
 	if cli == nil {
 		return "", fmt.Errorf("Cannot get token from service account, k8s client is nil")
 	}
 
 	// Getting SA
-	saClient := &corev1.ServiceAccount{}
-	err := cli.Get(context.TODO(), types.NamespacedName{Name: saName, Namespace: ns}, saClient)
-	if err != nil && errors.IsNotFound(err) {
-		return "", fmt.Errorf("Unable to retrieve service account, err=%v", err)
+	sa := &corev1.ServiceAccount{}
+	err := cli.Get(context.TODO(), types.NamespacedName{Name: saName, Namespace: ns}, sa)
+	if errors.IsNotFound(err) {
+		return "", &ServiceAccountNotFoundError{Namespace: ns, Name: saName}
+	} else if err != nil {
+		return "", fmt.Errorf("Unable to retrieve service account %s/%s, err=%v", ns, saName, err)
+	}
+
+	var candidates []corev1.Secret
+	var rejected []string
+	linked := make(map[string]bool)
+	for _, ref := range sa.Secrets {
+		linked[ref.Name] = true
+		secret := &corev1.Secret{}
+		if err := cli.Get(context.TODO(), types.NamespacedName{Name: ref.Name, Namespace: ns}, secret); err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s: %v", ref.Name, err))
+			continue
+		}
+		candidates = append(candidates, *secret)
+	}
+
+	// Discovering token secrets not linked to the service account
+	secrets := &corev1.SecretList{}
+	if err := cli.List(context.TODO(), secrets, client.InNamespace(ns)); err != nil {
+		return "", fmt.Errorf("Unable to list secrets in namespace %s, err=%v", ns, err)
+	}
+	for _, secret := range secrets.Items {
+		if !linked[secret.Name] && secret.Type == corev1.SecretTypeServiceAccountToken &&
+			secret.Annotations[corev1.ServiceAccountNameKey] == saName {
+			candidates = append(candidates, secret)
+		}
+	}
+
+	for i := range candidates {
+		token, err := getServiceAccountToken(&candidates[i], sa)
+		if err != nil {
+			rejected = append(rejected, fmt.Sprintf("%s: %v", candidates[i].Name, err))
+			continue
+		}
+		return token, nil
+	}
+
+	return "", &NoValidServiceAccountTokenError{Namespace: ns, Name: saName, Rejected: rejected}
+}
+
+// getServiceAccountToken checks that a secret is a token secret of the service account
+// and returns its token if not expired
+func getServiceAccountToken(secret *corev1.Secret, sa *corev1.ServiceAccount) (string, error) {
+	if secret.Type != corev1.SecretTypeServiceAccountToken {
+		return "", fmt.Errorf("wrong secret type %s", secret.Type)
+	}
+	if secret.Annotations[corev1.ServiceAccountNameKey] != sa.Name {
+		return "", fmt.Errorf("secret belongs to service account %s", secret.Annotations[corev1.ServiceAccountNameKey])
+	}
+	if uid := secret.Annotations[corev1.ServiceAccountUIDKey]; uid != "" && sa.UID != "" && uid != string(sa.UID) {
+		return "", fmt.Errorf("secret belongs to a previous service account with the same name")
 	}
 
-	if len(saClient.Secrets) == 0 {
-		return "", fmt.Errorf("No secret associated with the service account %s/%s", ns, saName)
+	token := string(secret.Data[corev1.ServiceAccountTokenKey])
+	if token == "" {
+		return "", fmt.Errorf("empty token")
+	}
+
+	expiration, err := jwtExpiration(token)
+	if err != nil {
+		return "", err
+	}
+	if !expiration.IsZero() && time.Now().After(expiration) {
+		return "", fmt.Errorf("token expired at %s", expiration.Format(time.RFC3339))
+	}
+
+	return token, nil
+}
+
+// jwtExpiration returns the expiration of a jwt token without verifying it
+// A zero time is returned if the token does not expire
+func jwtExpiration(jwt string) (time.Time, error) {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return time.Time{}, fmt.Errorf("token is not a valid jwt")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to decode jwt claims, err=%v", err)
+	}
+
+	claims := struct {
+		Expiration int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return time.Time{}, fmt.Errorf("unable to decode jwt claims, err=%v", err)
+	}
+
+	if claims.Expiration == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(claims.Expiration, 0), nil
+}
+
+// GetTLSKeyPair gets the certificate and the private key from a k8s' kubernetes.io/tls secret
+func GetTLSKeyPair(cli client.Client, ns, name string) ([]byte, []byte, error) {
+	cert, err := GetSecretValue(cli, ns, name, corev1.TLSCertKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := GetSecretValue(cli, ns, name, corev1.TLSPrivateKeyKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+// GetBasicAuthCredentials gets a username and a password from a k8s' secret
+// Keys default to the ones of a kubernetes.io/basic-auth secret if empty
+func GetBasicAuthCredentials(cli client.Client, ns, name, usernameKey, passwordKey string) (string, string, error) {
+	if usernameKey == "" {
+		usernameKey = corev1.BasicAuthUsernameKey
+	}
+	if passwordKey == "" {
+		passwordKey = corev1.BasicAuthPasswordKey
+	}
+
+	username, err := GetSecretValue(cli, ns, name, usernameKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	password, err := GetSecretValue(cli, ns, name, passwordKey)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(username), string(password), nil
+}
+
+// GetConfigMapValue gets the value associated to a key of a k8s' config map
+func GetConfigMapValue(cli client.Client, ns, name, key string) ([]byte, error) {
+	if cli == nil {
+		return nil, fmt.Errorf("Cannot get config map value, k8s client is nil")
+	}
+
+	configMap := &corev1.ConfigMap{}
+	err := cli.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: ns}, configMap)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to retrieve the config map %s/%s, err=%v", ns, name, err)
+	}
+
+	if val, ok := configMap.Data[key]; ok {
+		return []byte(val), nil
+	}
+	if val, ok := configMap.BinaryData[key]; ok {
+		return val, nil
+	}
+
+	return nil, fmt.Errorf("Key %s does not exist in the config map %s/%s", key, ns, name)
+}
+
+// GetSecretValue gets the value associated to a key of a k8s' secret
+func GetSecretValue(cli client.Client, ns, name, key string) ([]byte, error) {
+	if cli == nil {
+		return nil, fmt.Errorf("Cannot get secret value, k8s client is nil")
 	}
 
-	// TODO See how to handle this slice of Secrets instead of taking the first one
-	saSecret := saClient.Secrets[0]
 	secret := &corev1.Secret{}
-	err = cli.Get(context.TODO(), types.NamespacedName{Name: saSecret.Name, Namespace: ns}, secret)
+	err := cli.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: ns}, secret)
 	if err != nil {
-		return "", fmt.Errorf("Unable to retrieve the secret from the service account, err=%v", err)
+		return nil, fmt.Errorf("Unable to retrieve the secret %s/%s, err=%v", ns, name, err)
+	}
+
+	val, ok := secret.Data[key]
+	if !ok {
+		return nil, &SecretKeyNotFoundError{Namespace: ns, Name: name, Key: key}
 	}
 
-	// Finally, set the token
-	return string(secret.Data["token"]), nil
+	return val, nil
 }
@@ -0,0 +1,143 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package k8sutils
+
+import (
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// testJWT returns an unsigned jwt token with the given claims
+func testJWT(claims string) string {
+	return "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".signature"
+}
+
+// tokenSecret returns a token secret annotated with the given service account name and UID
+func tokenSecret(name, saName, uid, token string) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name, Annotations: map[string]string{
+			corev1.ServiceAccountNameKey: saName,
+			corev1.ServiceAccountUIDKey:  uid,
+		}},
+		Type: corev1.SecretTypeServiceAccountToken,
+		Data: map[string][]byte{corev1.ServiceAccountTokenKey: []byte(token)},
+	}
+}
+
+func TestGetTokenFromSA(t *testing.T) {
+	valid := testJWT(fmt.Sprintf(`{"sub":"system:serviceaccount:ns:reader","exp":%d}`, time.Now().Add(time.Hour).Unix()))
+	expired := testJWT(fmt.Sprintf(`{"sub":"system:serviceaccount:ns:reader","exp":%d}`, time.Now().Add(-time.Hour).Unix()))
+	legacy := testJWT(`{"sub":"system:serviceaccount:ns:reader"}`)
+
+	sa := func(secrets ...string) *corev1.ServiceAccount {
+		s := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "reader", UID: types.UID("uid-1")}}
+		for _, name := range secrets {
+			s.Secrets = append(s.Secrets, corev1.ObjectReference{Name: name})
+		}
+		return s
+	}
+	opaque := tokenSecret("opaque", "reader", "uid-1", valid)
+	opaque.Type = corev1.SecretTypeOpaque
+
+	tests := []struct {
+		name       string
+		objects    []runtime.Object
+		want       string
+		wantReason string
+	}{
+		{name: "linked secret", objects: []runtime.Object{sa("token"), tokenSecret("token", "reader", "uid-1", valid)},
+			want: valid},
+		{name: "linked secret without expiration", objects: []runtime.Object{sa("token"), tokenSecret("token", "reader", "uid-1", legacy)},
+			want: legacy},
+		{name: "annotated secret not linked", objects: []runtime.Object{sa(), tokenSecret("token", "reader", "uid-1", valid)},
+			want: valid},
+		{name: "secret of another service account is not discovered", objects: []runtime.Object{sa(), tokenSecret("token", "writer", "uid-2", valid)},
+			wantReason: ReasonNoValidServiceAccountToken},
+		{name: "linked secret of another service account", objects: []runtime.Object{sa("token"), tokenSecret("token", "writer", "uid-2", valid)},
+			wantReason: ReasonNoValidServiceAccountToken},
+		{name: "secret of a previous service account with the same name", objects: []runtime.Object{sa("token"), tokenSecret("token", "reader", "uid-0", valid)},
+			wantReason: ReasonNoValidServiceAccountToken},
+		{name: "wrong secret type", objects: []runtime.Object{sa("opaque"), opaque},
+			wantReason: ReasonNoValidServiceAccountToken},
+		{name: "expired token", objects: []runtime.Object{sa("token"), tokenSecret("token", "reader", "uid-1", expired)},
+			wantReason: ReasonNoValidServiceAccountToken},
+		{name: "expired token, valid annotated secret", objects: []runtime.Object{sa("expired"), tokenSecret("expired", "reader", "uid-1", expired), tokenSecret("token", "reader", "uid-1", valid)},
+			want: valid},
+		{name: "missing linked secret", objects: []runtime.Object{sa("token")},
+			wantReason: ReasonNoValidServiceAccountToken},
+		{name: "missing service account", objects: []runtime.Object{tokenSecret("token", "reader", "uid-1", valid)},
+			wantReason: ReasonServiceAccountNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cli := fake.NewFakeClientWithScheme(scheme.Scheme, tt.objects...)
+			got, err := GetTokenFromSA(cli, "ns", "reader")
+			if tt.wantReason != "" {
+				reasoner, ok := err.(interface{ Reason() string })
+				if !ok || reasoner.Reason() != tt.wantReason {
+					t.Fatalf("GetTokenFromSA() err=%v, want reason %s", err, tt.wantReason)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetTokenFromSA() err=%v", err)
+			}
+			if got != tt.want {
+				t.Errorf("GetTokenFromSA()=%s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWTExpiration(t *testing.T) {
+	tests := []struct {
+		name    string
+		jwt     string
+		want    time.Time
+		wantErr bool
+	}{
+		{name: "expiration", jwt: testJWT(`{"exp":1700000000}`), want: time.Unix(1700000000, 0)},
+		{name: "no expiration", jwt: testJWT(`{"sub":"system:serviceaccount:ns:reader"}`)},
+		{name: "padded claims", jwt: "header." + base64.URLEncoding.EncodeToString([]byte(`{"exp": 1700000000}`)) + ".signature",
+			want: time.Unix(1700000000, 0)},
+		{name: "not a jwt", jwt: "s.token", wantErr: true},
+		{name: "claims not base64", jwt: "header.!!!.signature", wantErr: true},
+		{name: "claims not json", jwt: testJWT(`not json`), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jwtExpiration(tt.jwt)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("jwtExpiration() err=%v, wantErr %t", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("jwtExpiration()=%s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -17,18 +17,31 @@ limitations under the License.
 package vault
 
 import (
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"net/http"
+	"sync"
 
 	vapi "github.com/hashicorp/vault/api"
 )
 
 var _ AuthProvider = (*AppRoleProvider)(nil)
 
+var (
+	// unwrappedSecretIDs keeps in memory the secret IDs unwrapped from response-wrapping tokens
+	// as such a token can only be unwrapped once. Keys are hashes of the wrapping tokens.
+	// Entries are evicted once no owner references their wrapping token anymore.
+	unwrappedSecretIDs = make(map[string]string)
+	// wrappingTokenOwners maps an owner (e.g. a custom resource) to the hashes of the wrapping tokens it references
+	wrappingTokenOwners     = make(map[string][]string)
+	unwrappedSecretIDsMutex sync.Mutex
+)
+
 // AppRoleProvider is a provider to connect to vault using AppRole
 type AppRoleProvider struct {
 	AppRoleName, RoleID, SecretID string
+	// wrappingToken is a response-wrapping token to unwrap to get the SecretID
+	wrappingToken string
 }
 
 // NewAppRoleProvider creates a pointer to a AppRoleProvider struct
@@ -40,28 +53,35 @@ func NewAppRoleProvider(appRoleName, roleID, secretID string) *AppRoleProvider {
 	}
 }
 
+// SetWrappedSecretID sets a response-wrapping token to unwrap on first use to get the SecretID
+func (a *AppRoleProvider) SetWrappedSecretID(wrappingToken string) {
+	a.wrappingToken = wrappingToken
+}
+
+// Identity returns the role and secret IDs the provider logs in with
+func (a AppRoleProvider) Identity() string {
+	return fmt.Sprintf("approle:%s:%s:%s:%s", a.AppRoleName, a.RoleID, a.SecretID, a.wrappingToken)
+}
+
 // Login authenticates to the configured vault server
 func (a AppRoleProvider) Login(c *Config) (*vapi.Client, error) {
 	log.Info("Authenticating using AppRole auth method")
-	config := vapi.DefaultConfig()
-	config.Address = c.Address
-	config.HttpClient.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: c.Insecure},
-	}
-
-	vclient, err := vapi.NewClient(config)
+	vclient, err := c.newClient()
 	if err != nil {
 		return nil, err
 	}
 
-	vaultNamespace := c.Namespace
-	if vaultNamespace != "" {
-		vclient.SetNamespace(vaultNamespace)
+	secretID := a.SecretID
+	if a.wrappingToken != "" {
+		secretID, err = unwrapSecretID(vclient, a.wrappingToken)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	data := map[string]interface{}{
 		"role_id":   a.RoleID,
-		"secret_id": a.SecretID,
+		"secret_id": secretID,
 	}
 	s, err := vclient.Logical().Write(fmt.Sprintf("auth/%s/login", a.AppRoleName), data)
 	if err != nil {
@@ -71,3 +91,103 @@ func (a AppRoleProvider) Login(c *Config) (*vapi.Client, error) {
 	vclient.SetToken(s.Auth.ClientToken)
 	return vclient, nil
 }
+
+// retainUnwrappedSecretIDs records the wrapping tokens referenced by the owner's provider, replacing the ones
+// it referenced before. The secret IDs of the wrapping tokens not referenced by any owner anymore are evicted.
+func retainUnwrappedSecretIDs(owner string, p AuthProvider) {
+	var keys []string
+	for _, wrappingToken := range wrappingTokens(p) {
+		keys = append(keys, wrappingTokenKey(wrappingToken))
+	}
+
+	unwrappedSecretIDsMutex.Lock()
+	defer unwrappedSecretIDsMutex.Unlock()
+
+	if len(keys) > 0 {
+		wrappingTokenOwners[owner] = keys
+	} else {
+		delete(wrappingTokenOwners, owner)
+	}
+	evictUnwrappedSecretIDsLocked()
+}
+
+// releaseUnwrappedSecretIDs removes the references of the owner, evicting the secret IDs not referenced anymore
+func releaseUnwrappedSecretIDs(owner string) {
+	unwrappedSecretIDsMutex.Lock()
+	defer unwrappedSecretIDsMutex.Unlock()
+
+	delete(wrappingTokenOwners, owner)
+	evictUnwrappedSecretIDsLocked()
+}
+
+// evictUnwrappedSecretIDsLocked evicts the secret IDs not referenced by any owner, unwrappedSecretIDsMutex must be held
+func evictUnwrappedSecretIDsLocked() {
+	referenced := make(map[string]bool)
+	for _, keys := range wrappingTokenOwners {
+		for _, key := range keys {
+			referenced[key] = true
+		}
+	}
+	for key := range unwrappedSecretIDs {
+		if !referenced[key] {
+			delete(unwrappedSecretIDs, key)
+		}
+	}
+}
+
+// wrappingTokens returns the response-wrapping tokens used by a provider
+func wrappingTokens(p AuthProvider) []string {
+	switch provider := p.(type) {
+	case *AppRoleProvider:
+		return wrappingTokens(*provider)
+	case AppRoleProvider:
+		if provider.wrappingToken != "" {
+			return []string{provider.wrappingToken}
+		}
+	case *ChainProvider:
+		var tokens []string
+		for _, chained := range provider.Providers {
+			tokens = append(tokens, wrappingTokens(chained)...)
+		}
+		return tokens
+	}
+	return nil
+}
+
+// wrappingTokenKey returns the key of a wrapping token in unwrappedSecretIDs
+func wrappingTokenKey(wrappingToken string) string {
+	hash := sha256.Sum256([]byte(wrappingToken))
+	return hex.EncodeToString(hash[:])
+}
+
+// unwrapSecretID gets the secret ID from a response-wrapping token, unwrapping it on first use only
+func unwrapSecretID(vclient *vapi.Client, wrappingToken string) (string, error) {
+	key := wrappingTokenKey(wrappingToken)
+
+	unwrappedSecretIDsMutex.Lock()
+	defer unwrappedSecretIDsMutex.Unlock()
+
+	if secretID, found := unwrappedSecretIDs[key]; found {
+		return secretID, nil
+	}
+
+	log.Info("Unwrapping AppRole secret ID")
+	s, err := vclient.Logical().Unwrap(wrappingToken)
+	// Unwrap uses the wrapping token as the client token, it is not valid anymore
+	vclient.ClearToken()
+	if err != nil {
+		// A token which cannot be unwrapped might have been intercepted and used by someone else
+		return "", fmt.Errorf("Unable to unwrap AppRole secret ID, the wrapping token might have been tampered with, err=%v", err)
+	}
+	if s == nil || s.Data["secret_id"] == nil {
+		return "", fmt.Errorf("Unable to unwrap AppRole secret ID, no secret_id found in the wrapped response")
+	}
+
+	secretID, ok := s.Data["secret_id"].(string)
+	if !ok {
+		return "", fmt.Errorf("Unable to unwrap AppRole secret ID, secret_id is not a string")
+	}
+
+	unwrappedSecretIDs[key] = secretID
+	return secretID, nil
+}
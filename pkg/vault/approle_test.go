@@ -0,0 +1,130 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const routeUnwrap = "PUT /v1/sys/wrapping/unwrap"
+
+// resetUnwrappedSecretIDs empties the unwrapped secret IDs and their references
+func resetUnwrappedSecretIDs() {
+	unwrappedSecretIDsMutex.Lock()
+	defer unwrappedSecretIDsMutex.Unlock()
+	unwrappedSecretIDs = make(map[string]string)
+	wrappingTokenOwners = make(map[string][]string)
+}
+
+// newWrappingStub starts a vault stub unwrapping each wrapping token once (wrapping-N gives secret-N), a used wrapping token
+// being rejected the same way as an expired one
+// AppRole logins succeed with any unwrapped secret ID and mint tokens expiring right away, a new login is done on each use
+func newWrappingStub(t *testing.T) *vaultStub {
+	var mutex sync.Mutex
+	unwrapped := make(map[string]bool)
+	var logins int64
+	return newVaultStub(t, map[string]http.HandlerFunc{
+		routeUnwrap: func(w http.ResponseWriter, req *http.Request) {
+			wrappingToken := req.Header.Get("X-Vault-Token")
+			mutex.Lock()
+			used := unwrapped[wrappingToken]
+			unwrapped[wrappingToken] = true
+			mutex.Unlock()
+			if used || !strings.HasPrefix(wrappingToken, "wrapping-") {
+				writeJSON(w, http.StatusBadRequest, map[string]interface{}{"errors": []string{"wrapping token is not valid or does not exist"}})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"data": map[string]interface{}{"secret_id": strings.Replace(wrappingToken, "wrapping-", "secret-", 1)},
+			})
+		},
+		routeAppRoleLogin: func(w http.ResponseWriter, req *http.Request) {
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"auth": map[string]interface{}{"client_token": fmt.Sprintf("token-%d", atomic.AddInt64(&logins, 1)), "lease_duration": 1},
+			})
+		},
+		routeLookupSelf: func(w http.ResponseWriter, req *http.Request) {
+			if !strings.HasPrefix(req.Header.Get("X-Vault-Token"), "token-") {
+				writeJSON(w, http.StatusForbidden, map[string]interface{}{"errors": []string{"permission denied"}})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"ttl": 1}})
+		},
+		routeRevokeSelf: respond(http.StatusNoContent, nil),
+	})
+}
+
+func TestAppRoleWrappedSecretID(t *testing.T) {
+	defer resetUnwrappedSecretIDs()
+	stub := newWrappingStub(t)
+	defer stub.Close()
+
+	provider := func(wrappingToken string) AuthProvider {
+		p := NewAppRoleProvider("approle", "role-id", "")
+		p.SetWrappedSecretID(wrappingToken)
+		return p
+	}
+	chain := func(wrappingToken string) AuthProvider {
+		return NewChainProvider(NewTokenProvider("invalid"), provider(wrappingToken))
+	}
+
+	m := NewTokenManager()
+	c := stub.config()
+	// Each step logs in again as tokens expire right away
+	steps := []struct {
+		name         string
+		owner        string
+		provider     AuthProvider
+		release      string
+		wantErr      bool
+		wantSecretID string
+		wantUnwraps  int
+	}{
+		{name: "unwrapped on first login", owner: "ns/a", provider: provider("wrapping-1"), wantSecretID: "secret-1", wantUnwraps: 1},
+		{name: "kept for the next logins, once the wrapping token is not valid anymore", owner: "ns/a", provider: provider("wrapping-1"), wantSecretID: "secret-1", wantUnwraps: 1},
+		{name: "shared with another owner", owner: "ns/b", provider: chain("wrapping-1"), wantSecretID: "secret-1", wantUnwraps: 1},
+		{name: "kept while referenced by an owner", release: "ns/a", owner: "ns/b", provider: chain("wrapping-1"), wantSecretID: "secret-1", wantUnwraps: 1},
+		{name: "new wrapping token unwrapped", owner: "ns/b", provider: chain("wrapping-2"), wantSecretID: "secret-2", wantUnwraps: 2},
+		{name: "evicted once not referenced anymore", owner: "ns/c", provider: provider("wrapping-1"), wantErr: true, wantUnwraps: 3},
+		{name: "evicted once owner released", release: "ns/b", owner: "ns/c", provider: provider("wrapping-2"), wantErr: true, wantUnwraps: 4},
+	}
+
+	for _, step := range steps {
+		if step.release != "" {
+			m.Release(step.release)
+		}
+		_, err := m.Client(step.owner, c, step.provider)
+		if (err != nil) != step.wantErr {
+			t.Fatalf("%s: Client() err=%v, wantErr %t", step.name, err, step.wantErr)
+		}
+		if got := len(stub.received(routeUnwrap)); got != step.wantUnwraps {
+			t.Errorf("%s: unwraps=%d, want %d", step.name, got, step.wantUnwraps)
+		}
+		if step.wantErr {
+			continue
+		}
+		logins := stub.received(routeAppRoleLogin)
+		if got := logins[len(logins)-1].body["secret_id"]; got != step.wantSecretID {
+			t.Errorf("%s: secret_id=%v, want %s", step.name, got, step.wantSecretID)
+		}
+	}
+}
@@ -17,6 +17,11 @@ limitations under the License.
 package vault
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
 	vapi "github.com/hashicorp/vault/api"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 )
@@ -27,9 +32,21 @@ var (
 
 // Config is a struct to configure a vault connection
 type Config struct {
-	Address   string
+	Address string
+	// Addresses is an ordered list of vault servers to choose Address from, see SelectAddress
+	Addresses []string
 	Namespace string
 	Insecure  bool
+	// CACert is a PEM encoded CA bundle to verify the vault server's certificate, system's CAs are used if empty
+	CACert []byte
+	// TLSServerName is the name used to verify the vault server's certificate, the address' host is used if empty
+	TLSServerName string
+	// ClientCert and ClientKey are a PEM encoded certificate and key presented to the vault server, optional
+	ClientCert, ClientKey []byte
+	// Consistency is the consistency mode of the requests served by performance standby nodes, bestEffort if empty
+	Consistency ConsistencyMode
+	// ClientFactory creates the vault clients, a default one is used if nil
+	ClientFactory *ClientFactory
 }
 
 // NewConfig creates a pointer to a VaultConfig struct
@@ -44,4 +61,62 @@ func NewConfig(address string) *Config {
 // AuthProvider is an interface to abstract vault methods' connection
 type AuthProvider interface {
 	Login(*Config) (*vapi.Client, error)
+	// Identity returns a string identifying who the provider logs in as, it may contain credentials
+	Identity() string
+}
+
+// AuthMethodName returns the name of the auth method used by the provider
+func AuthMethodName(p AuthProvider) string {
+	switch provider := p.(type) {
+	case *TokenProvider, TokenProvider:
+		return "token"
+	case *TokenFileProvider, TokenFileProvider:
+		return "tokenFile"
+	case *AppRoleProvider, AppRoleProvider:
+		return "approle"
+	case *KubernetesProvider, KubernetesProvider:
+		return "kubernetes"
+	case *JWTProvider, JWTProvider:
+		return "jwt"
+	case *CertProvider, CertProvider:
+		return "cert"
+	case *UserPassProvider, UserPassProvider:
+		return "userpass"
+	case *LDAPProvider, LDAPProvider:
+		return "ldap"
+	case *AWSIAMProvider, AWSIAMProvider:
+		return "aws"
+	case *ChainProvider:
+		if provider.succeeded != nil {
+			return AuthMethodName(provider.succeeded)
+		}
+	}
+	return ""
+}
+
+// newTLSConfig creates the TLS configuration to use to connect to the vault server
+// It is shared by all the providers, which may complete it (e.g. with their own client certificate)
+func newTLSConfig(c *Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: c.Insecure,
+		ServerName:         c.TLSServerName,
+	}
+
+	if len(c.CACert) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(c.CACert) {
+			return nil, errors.New("Unable to parse the vault CA certificate")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(c.ClientCert) > 0 || len(c.ClientKey) > 0 {
+		clientCert, err := tls.X509KeyPair(c.ClientCert, c.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to load vault client certificate, err=%v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
 }
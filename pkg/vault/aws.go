@@ -0,0 +1,173 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sts"
+	vapi "github.com/hashicorp/vault/api"
+)
+
+const (
+	// AWSDefaultSTSRegion is the region used to sign the sts:GetCallerIdentity request if none is provided
+	AWSDefaultSTSRegion = "us-east-1"
+	// AWSIAMServerIDHeader is the header vault uses to mitigate replay attacks
+	AWSIAMServerIDHeader = "X-Vault-AWS-IAM-Server-ID"
+	// AWSRoleSessionName is the session name used when assuming a role with a web identity token
+	AWSRoleSessionName = "vault-secret-operator"
+)
+
+var _ AuthProvider = (*AWSIAMProvider)(nil)
+
+// AWSIAMProvider is a provider to authenticate using the iam type of the Vault AWS Auth Method
+// https://www.vaultproject.io/docs/auth/aws
+type AWSIAMProvider struct {
+	// Path is the mount path of the auth method used to call the login URL
+	Path string
+	// Role to use for the authentication
+	Role string
+	// STSRegion is the region used to sign the request, using AWSDefaultSTSRegion if empty
+	STSRegion string
+	// STSEndpoint overrides the endpoint of the STS service
+	STSEndpoint string
+	// IAMServerIDHeaderValue is the value of the AWSIAMServerIDHeader header, if configured on vault side
+	IAMServerIDHeaderValue string
+	// Static credentials, web identity credentials (IRSA) are used if empty
+	accessKeyID, secretAccessKey, sessionToken string
+}
+
+// NewAWSIAMProvider creates a pointer to a AWSIAMProvider struct
+func NewAWSIAMProvider(path, role, stsRegion, stsEndpoint, iamServerIDHeaderValue string) *AWSIAMProvider {
+	return &AWSIAMProvider{
+		Path:                   path,
+		Role:                   role,
+		STSRegion:              stsRegion,
+		STSEndpoint:            stsEndpoint,
+		IAMServerIDHeaderValue: iamServerIDHeaderValue,
+	}
+}
+
+// SetStaticCredentials sets the credentials to use to sign the request
+func (p *AWSIAMProvider) SetStaticCredentials(accessKeyID, secretAccessKey, sessionToken string) {
+	p.accessKeyID = accessKeyID
+	p.secretAccessKey = secretAccessKey
+	p.sessionToken = sessionToken
+}
+
+// Identity returns the role and the credentials used to sign the request
+func (p AWSIAMProvider) Identity() string {
+	return fmt.Sprintf("aws:%s:%s:%s:%s", p.Path, p.Role, p.accessKeyID, p.secretAccessKey)
+}
+
+// Login authenticates to the configured vault server
+func (p AWSIAMProvider) Login(c *Config) (*vapi.Client, error) {
+	reqLogger := log.WithValues("func", "AWSIAMProvider.Login")
+	reqLogger.Info("Authenticating using AWS IAM auth method")
+
+	loginData, err := p.signedGetCallerIdentity()
+	if err != nil {
+		return nil, err
+	}
+
+	vclient, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	loginData["role"] = p.Role
+	s, err := vclient.Logical().Write(fmt.Sprintf("auth/%s/login", p.Path), loginData)
+	if err != nil {
+		return nil, err
+	}
+
+	vclient.SetToken(s.Auth.ClientToken)
+	return vclient, nil
+}
+
+// signedGetCallerIdentity builds and signs a sts:GetCallerIdentity request
+// and returns it the way the vault login endpoint expects it
+func (p AWSIAMProvider) signedGetCallerIdentity() (map[string]interface{}, error) {
+	region := p.STSRegion
+	if region == "" {
+		region = AWSDefaultSTSRegion
+	}
+
+	awsConfig := aws.NewConfig().WithRegion(region)
+	if p.STSEndpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(p.STSEndpoint)
+	}
+
+	sess, err := session.NewSession(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := p.credentials(sess)
+	if err != nil {
+		return nil, err
+	}
+
+	svc := sts.New(sess, aws.NewConfig().WithCredentials(creds))
+	req, _ := svc.GetCallerIdentityRequest(nil)
+	if p.IAMServerIDHeaderValue != "" {
+		req.HTTPRequest.Header.Add(AWSIAMServerIDHeader, p.IAMServerIDHeaderValue)
+	}
+	if err := req.Sign(); err != nil {
+		return nil, fmt.Errorf("Unable to sign sts:GetCallerIdentity request, err=%v", err)
+	}
+
+	headers, err := json.Marshal(req.HTTPRequest.Header)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(req.HTTPRequest.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"iam_http_request_method": req.HTTPRequest.Method,
+		"iam_request_url":         base64.StdEncoding.EncodeToString([]byte(req.HTTPRequest.URL.String())),
+		"iam_request_headers":     base64.StdEncoding.EncodeToString(headers),
+		"iam_request_body":        base64.StdEncoding.EncodeToString(body),
+	}, nil
+}
+
+// credentials returns the static credentials if set, the web identity ones otherwise
+func (p AWSIAMProvider) credentials(sess *session.Session) (*credentials.Credentials, error) {
+	if p.accessKeyID != "" || p.secretAccessKey != "" {
+		return credentials.NewStaticCredentials(p.accessKeyID, p.secretAccessKey, p.sessionToken), nil
+	}
+
+	// IAM roles for service accounts, the role and token file are injected in the operator's pod
+	roleARN := os.Getenv("AWS_ROLE_ARN")
+	tokenFile := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE")
+	if roleARN == "" || tokenFile == "" {
+		return nil, fmt.Errorf("No AWS credentials available, please provide static credentials or configure web identity (AWS_ROLE_ARN and AWS_WEB_IDENTITY_TOKEN_FILE)")
+	}
+
+	return stscreds.NewWebIdentityCredentials(sess, roleARN, AWSRoleSessionName, tokenFile), nil
+}
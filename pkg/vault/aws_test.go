@@ -0,0 +1,178 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+const routeAWSLogin = "PUT /v1/auth/aws/login"
+
+// newSTSStub starts a fake STS service answering sts:AssumeRoleWithWebIdentity with the ASIAWEBIDENTITY access key
+func newSTSStub(t *testing.T, assumed *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		if req.Form.Get("Action") != "AssumeRoleWithWebIdentity" || req.Form.Get("WebIdentityToken") != "web-identity-token" {
+			t.Errorf("STS request=%v, want AssumeRoleWithWebIdentity with the token file's content", req.Form)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt64(assumed, 1)
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAWEBIDENTITY</AccessKeyId>
+      <SecretAccessKey>web-identity-secret</SecretAccessKey>
+      <SessionToken>web-identity-session</SessionToken>
+      <Expiration>2100-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	}))
+}
+
+// setEnv sets env vars and returns a function restoring them
+func setEnv(vars map[string]string) func() {
+	previous := make(map[string]*string)
+	for name, value := range vars {
+		if old, found := os.LookupEnv(name); found {
+			previous[name] = &old
+		} else {
+			previous[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, old := range previous {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+func TestAWSIAMProviderLogin(t *testing.T) {
+	var assumed int64
+	sts := newSTSStub(t, &assumed)
+	defer sts.Close()
+
+	tokenFile, err := ioutil.TempFile("", "web-identity-token")
+	if err != nil {
+		t.Fatalf("TempFile() err=%v", err)
+	}
+	defer os.Remove(tokenFile.Name())
+	tokenFile.WriteString("web-identity-token")
+	tokenFile.Close()
+
+	tests := []struct {
+		name          string
+		static        bool
+		env           map[string]string
+		serverID      string
+		wantErr       bool
+		wantAccessKey string
+		wantAssumed   int64
+	}{
+		{name: "static credentials", static: true, serverID: "vault.example.com", wantAccessKey: "AKIASTATIC"},
+		{name: "web identity", env: map[string]string{"AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/operator", "AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile.Name()},
+			wantAccessKey: "ASIAWEBIDENTITY", wantAssumed: 1},
+		{name: "no credentials", env: map[string]string{"AWS_ROLE_ARN": "", "AWS_WEB_IDENTITY_TOKEN_FILE": ""}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer setEnv(tt.env)()
+			atomic.StoreInt64(&assumed, 0)
+			stub := newVaultStub(t, map[string]http.HandlerFunc{
+				routeAWSLogin: respond(http.StatusOK, map[string]interface{}{"auth": map[string]interface{}{"client_token": "aws-token"}}),
+			})
+			defer stub.Close()
+
+			p := NewAWSIAMProvider("aws", "app", "eu-west-1", sts.URL, tt.serverID)
+			if tt.static {
+				p.SetStaticCredentials("AKIASTATIC", "static-secret", "")
+			}
+			vclient, err := p.Login(stub.config())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Login() err=%v, wantErr %t", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt64(&assumed); got != tt.wantAssumed {
+				t.Errorf("AssumeRoleWithWebIdentity calls=%d, want %d", got, tt.wantAssumed)
+			}
+			if tt.wantErr {
+				if got := len(stub.received(routeAWSLogin)); got != 0 {
+					t.Errorf("logins=%d, want 0", got)
+				}
+				return
+			}
+			if vclient.Token() != "aws-token" {
+				t.Errorf("Token()=%s, want aws-token", vclient.Token())
+			}
+
+			requests := stub.received(routeAWSLogin)
+			if len(requests) != 1 {
+				t.Fatalf("logins=%d, want 1", len(requests))
+			}
+			body := requests[0].body
+			decode := func(field string) string {
+				value, _ := body[field].(string)
+				decoded, err := base64.StdEncoding.DecodeString(value)
+				if err != nil {
+					t.Fatalf("%s is not base64 encoded, err=%v", field, err)
+				}
+				return string(decoded)
+			}
+
+			if body["role"] != "app" || body["iam_http_request_method"] != http.MethodPost {
+				t.Errorf("login role=%v method=%v, want app POST", body["role"], body["iam_http_request_method"])
+			}
+			if requestURL, _ := url.Parse(decode("iam_request_url")); requestURL == nil || requestURL.Host != strings.TrimPrefix(sts.URL, "http://") {
+				t.Errorf("iam_request_url=%s, want %s", decode("iam_request_url"), sts.URL)
+			}
+			if got := decode("iam_request_body"); !strings.Contains(got, "Action=GetCallerIdentity") {
+				t.Errorf("iam_request_body=%s, want a GetCallerIdentity request", got)
+			}
+
+			var headers http.Header
+			if err := json.Unmarshal([]byte(decode("iam_request_headers")), &headers); err != nil {
+				t.Fatalf("iam_request_headers err=%v", err)
+			}
+			authorization := headers.Get("Authorization")
+			if !strings.Contains(authorization, "Credential="+tt.wantAccessKey+"/") || !strings.Contains(authorization, "/eu-west-1/sts/") {
+				t.Errorf("Authorization=%s, want a signature by %s for eu-west-1", authorization, tt.wantAccessKey)
+			}
+			if got := headers.Get(AWSIAMServerIDHeader); got != tt.serverID {
+				t.Errorf("%s=%s, want %s", AWSIAMServerIDHeader, got, tt.serverID)
+			}
+			if tt.serverID != "" && !strings.Contains(strings.ToLower(authorization), strings.ToLower(AWSIAMServerIDHeader)) {
+				t.Errorf("%s is not signed", AWSIAMServerIDHeader)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+var _ AuthProvider = (*CertProvider)(nil)
+
+// CertProvider is a provider to authenticate using the Vault TLS Certificates Auth Method
+// https://www.vaultproject.io/docs/auth/cert
+type CertProvider struct {
+	// Path is the mount path of the auth method used to call the login URL
+	Path string
+	// Role is the name of the certificate role to authenticate against, optional
+	Role string
+	// PEM encoded client certificate and key
+	cert, key []byte
+}
+
+// NewCertProvider creates a pointer to a CertProvider struct
+func NewCertProvider(path, role string, cert, key []byte) *CertProvider {
+	return &CertProvider{
+		Path: path,
+		Role: role,
+		cert: cert,
+		key:  key,
+	}
+}
+
+// Identity returns the role and a fingerprint of the client certificate
+func (p CertProvider) Identity() string {
+	return fmt.Sprintf("cert:%s:%s:%x", p.Path, p.Role, sha256.Sum256(p.cert))
+}
+
+// Login authenticates to the configured vault server
+func (p CertProvider) Login(c *Config) (*vapi.Client, error) {
+	reqLogger := log.WithValues("func", "CertProvider.Login")
+	reqLogger.Info("Authenticating using TLS certificates auth method")
+
+	if _, err := tls.X509KeyPair(p.cert, p.key); err != nil {
+		return nil, fmt.Errorf("Unable to load client certificate, err=%v", err)
+	}
+
+	// The provider's certificate is presented to the vault server instead of the configured one
+	certConfig := *c
+	certConfig.ClientCert = p.cert
+	certConfig.ClientKey = p.key
+	vclient, err := certConfig.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{}
+	if p.Role != "" {
+		data["name"] = p.Role
+	}
+	s, err := vclient.Logical().Write(fmt.Sprintf("auth/%s/login", p.Path), data)
+	if err != nil {
+		return nil, err
+	}
+
+	vclient.SetToken(s.Auth.ClientToken)
+	return vclient, nil
+}
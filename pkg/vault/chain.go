@@ -0,0 +1,82 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"fmt"
+	"strings"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+var _ AuthProvider = (*ChainProvider)(nil)
+
+// ChainProvider tries several providers in order until a login succeeds
+type ChainProvider struct {
+	Providers []AuthProvider
+	// succeeded is the provider of the last successful login
+	succeeded AuthProvider
+}
+
+// NewChainProvider creates a pointer to a ChainProvider struct
+func NewChainProvider(providers ...AuthProvider) *ChainProvider {
+	return &ChainProvider{
+		Providers: providers,
+	}
+}
+
+// Identity returns the identities of all the providers of the chain
+func (p *ChainProvider) Identity() string {
+	identities := make([]string, 0, len(p.Providers))
+	for _, provider := range p.Providers {
+		identities = append(identities, provider.Identity())
+	}
+	return "chain:" + strings.Join(identities, "|")
+}
+
+// Succeeded returns the provider of the last successful login, nil if none
+func (p *ChainProvider) Succeeded() AuthProvider {
+	return p.succeeded
+}
+
+// Login authenticates to the configured vault server using the first provider able to login
+func (p *ChainProvider) Login(c *Config) (*vapi.Client, error) {
+	reqLogger := log.WithValues("func", "ChainProvider.Login")
+
+	p.succeeded = nil
+	var errs []string
+	for _, provider := range p.Providers {
+		vclient, err := provider.Login(c)
+		if err == nil {
+			// Some providers do not contact vault when logging in (e.g. tokens), checking the token is usable
+			if _, err = vclient.Auth().Token().LookupSelf(); err != nil && mintsToken(provider) {
+				// The token has been minted but will not be used
+				revokeClient(vclient)
+			}
+		}
+		if err != nil {
+			reqLogger.Info("Unable to login, trying next auth method", "method", AuthMethodName(provider), "err", err.Error())
+			errs = append(errs, fmt.Sprintf("%s: %v", AuthMethodName(provider), err))
+			continue
+		}
+
+		p.succeeded = provider
+		return vclient, nil
+	}
+
+	return nil, fmt.Errorf("All auth methods failed, err=[%s]", strings.Join(errs, "; "))
+}
@@ -25,21 +25,21 @@ func NewCachedClient(client *vapi.Client) *CachedClient {
 }
 
 // Read implem for CachedClient struct
-func (c *CachedClient) Read(kvVersion int, kvPath string, secretPath string) (map[string]interface{}, error) {
+func (c *CachedClient) Read(kvVersion int, namespace string, kvPath string, secretPath string) (map[string]interface{}, error) {
 	reqLogger := log.WithValues("func", "CachedClient.Read")
 
 	var err error
 	var secret map[string]interface{}
 
-	cacheKey := fmt.Sprintf("%s/%s", kvPath, secretPath)
+	cacheKey := fmt.Sprintf("%s|%s/%s", namespace, kvPath, secretPath)
 	if cachedSecret, found := c.cache[cacheKey]; found {
-		reqLogger.Info("Retreiving vault value from cache", "kvPath", kvPath, "path", secretPath)
+		reqLogger.Info("Retreiving vault value from cache", "namespace", namespace, "kvPath", kvPath, "path", secretPath)
 		secret = cachedSecret
 		err = nil
 	} else {
-		secret, err = c.SimpleClient.Read(kvVersion, kvPath, secretPath)
+		secret, err = c.SimpleClient.Read(kvVersion, namespace, kvPath, secretPath)
 		if err == nil && secret != nil { // only cache value if there is no error and a sec returned
-			reqLogger.Info("Caching vault value", "kvPath", kvPath, "path", secretPath)
+			reqLogger.Info("Caching vault value", "namespace", namespace, "kvPath", kvPath, "path", secretPath)
 			c.cache[cacheKey] = secret
 		}
 	}
@@ -0,0 +1,391 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	vapi "github.com/hashicorp/vault/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+var _ prometheus.Collector = (*ClientFactory)(nil)
+
+// TransportEvictionTTL is the duration after which a transport not used anymore is evicted and its idle connections closed
+// (e.g. after the rotation of a CA bundle or client certificate)
+const TransportEvictionTTL = 30 * time.Minute
+
+var (
+	// defaultClientFactory is used when no factory is set in the configuration
+	defaultClientFactory = NewClientFactory(DefaultTransportConfig())
+
+	openConnectionsDesc = prometheus.NewDesc("vaultsecret_vault_open_connections",
+		"Number of open connections to a vault server", []string{"address"}, nil)
+	connectionsDesc = prometheus.NewDesc("vaultsecret_vault_connections_total",
+		"Number of connections opened to a vault server", []string{"address"}, nil)
+	requestsDesc = prometheus.NewDesc("vaultsecret_vault_requests_total",
+		"Number of requests sent to a vault server", []string{"address"}, nil)
+)
+
+// TransportConfig configures the HTTP transports used to connect to vault
+type TransportConfig struct {
+	// Timeout is the timeout of a request to vault
+	Timeout time.Duration
+	// DialTimeout is the timeout of a TCP connection
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout is the timeout of a TLS handshake
+	TLSHandshakeTimeout time.Duration
+	// KeepAlive is the interval between keep-alive probes, keep-alives are disabled if negative
+	KeepAlive time.Duration
+	// IdleConnTimeout is the duration after which an idle connection is closed
+	IdleConnTimeout time.Duration
+	// MaxIdleConns is the maximum number of idle connections across all hosts of a transport
+	MaxIdleConns int
+	// MaxIdleConnsPerHost is the maximum number of idle connections to a vault server
+	MaxIdleConnsPerHost int
+	// ProxyURL is the URL of the HTTP proxy to use, proxy env vars (HTTPS_PROXY, NO_PROXY, etc.) are used if empty
+	ProxyURL string
+	// MaxRetries is the maximum number of retries of a request failing with a transient error
+	MaxRetries int
+	// RetryWaitMin and RetryWaitMax bound the exponential backoff between two attempts
+	RetryWaitMin, RetryWaitMax time.Duration
+	// RateLimit is the maximum number of requests per second to a vault server, shared by all clients, no limit if 0
+	RateLimit float64
+	// RateLimitBurst is the number of requests which can be sent at once above RateLimit
+	RateLimitBurst int
+}
+
+// DefaultTransportConfig returns the default transport configuration
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		Timeout:             60 * time.Second,
+		DialTimeout:         30 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+		KeepAlive:           30 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		MaxRetries:          3,
+		RetryWaitMin:        500 * time.Millisecond,
+		RetryWaitMax:        30 * time.Second,
+		RateLimitBurst:      10,
+	}
+}
+
+// ClientFactory creates vault clients sharing HTTP transports, and so connections,
+// for the same vault server and TLS configuration.
+// Transports not used for TransportEvictionTTL are evicted, along with the rate limiters and replication
+// states of the vault servers they were the last ones to connect to.
+// It is safe for concurrent use.
+type ClientFactory struct {
+	config     TransportConfig
+	mutex      sync.Mutex
+	transports map[string]*pooledTransport
+	// limiters are the rate limiters of the vault servers, indexed by address
+	limiters map[string]*rate.Limiter
+	// states are the replication states seen from the vault servers, indexed by address
+	states map[string]*replicationStates
+}
+
+// pooledTransport is a transport shared by several clients
+type pooledTransport struct {
+	// Statistics, updated atomically, kept first for 64-bit alignment
+	openConnections, connections, requests int64
+	// lastUsed is the last time the transport has been used in nanoseconds since epoch, updated atomically
+	lastUsed  int64
+	address   string
+	transport *http.Transport
+}
+
+// TransportStats are the statistics of a transport, for debugging purpose
+type TransportStats struct {
+	Address         string
+	OpenConnections int64
+	Connections     int64
+	Requests        int64
+}
+
+// NewClientFactory creates a pointer to a ClientFactory struct
+func NewClientFactory(config TransportConfig) *ClientFactory {
+	return &ClientFactory{
+		config:     config,
+		transports: make(map[string]*pooledTransport),
+		limiters:   make(map[string]*rate.Limiter),
+		states:     make(map[string]*replicationStates),
+	}
+}
+
+// NewClient creates a vault client not logged in for the given configuration
+func (f *ClientFactory) NewClient(c *Config) (*vapi.Client, error) {
+	t, err := f.transport(c)
+	if err != nil {
+		return nil, err
+	}
+
+	config := vapi.DefaultConfig()
+	config.Address = c.Address
+	// Retries are done by the transport to honor the configured backoff and rate limit
+	config.MaxRetries = 0
+	config.HttpClient = &http.Client{
+		Transport: &consistencyTransport{
+			next: &retryTransport{
+				next:        t,
+				maxRetries:  f.config.MaxRetries,
+				minWait:     f.config.RetryWaitMin,
+				maxWait:     f.config.RetryWaitMax,
+				maxDuration: f.config.Timeout,
+				failover:    len(c.Addresses) > 1,
+				limiter:     f.limiter(c.Address),
+			},
+			mode:   c.Consistency,
+			states: f.replicationStates(c.Address),
+		},
+		Timeout: f.config.Timeout,
+		// Redirects are handled by the vault client
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	vclient, err := vapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Namespace != "" {
+		vclient.SetNamespace(c.Namespace)
+	}
+
+	return vclient, nil
+}
+
+// Stats returns the statistics of the transports, sorted by address
+func (f *ClientFactory) Stats() []TransportStats {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	stats := make([]TransportStats, 0, len(f.transports))
+	for _, t := range f.transports {
+		stats = append(stats, TransportStats{
+			Address:         t.address,
+			OpenConnections: atomic.LoadInt64(&t.openConnections),
+			Connections:     atomic.LoadInt64(&t.connections),
+			Requests:        atomic.LoadInt64(&t.requests),
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Address < stats[j].Address })
+
+	return stats
+}
+
+// Describe implements prometheus.Collector
+func (f *ClientFactory) Describe(ch chan<- *prometheus.Desc) {
+	ch <- openConnectionsDesc
+	ch <- connectionsDesc
+	ch <- requestsDesc
+}
+
+// Collect implements prometheus.Collector, statistics of the transports to the same address are summed up
+func (f *ClientFactory) Collect(ch chan<- prometheus.Metric) {
+	byAddress := make(map[string]TransportStats)
+	for _, s := range f.Stats() {
+		total := byAddress[s.Address]
+		total.OpenConnections += s.OpenConnections
+		total.Connections += s.Connections
+		total.Requests += s.Requests
+		byAddress[s.Address] = total
+	}
+
+	for address, s := range byAddress {
+		ch <- prometheus.MustNewConstMetric(openConnectionsDesc, prometheus.GaugeValue, float64(s.OpenConnections), address)
+		ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.CounterValue, float64(s.Connections), address)
+		ch <- prometheus.MustNewConstMetric(requestsDesc, prometheus.CounterValue, float64(s.Requests), address)
+	}
+}
+
+// limiter returns the rate limiter of a vault server, nil if the rate is not limited
+func (f *ClientFactory) limiter(address string) *rate.Limiter {
+	if f.config.RateLimit <= 0 {
+		return nil
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	l, found := f.limiters[address]
+	if !found {
+		burst := f.config.RateLimitBurst
+		if burst < 1 {
+			burst = 1
+		}
+		l = rate.NewLimiter(rate.Limit(f.config.RateLimit), burst)
+		f.limiters[address] = l
+	}
+
+	return l
+}
+
+// replicationStates returns the replication states seen from a vault server
+func (f *ClientFactory) replicationStates(address string) *replicationStates {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	s, found := f.states[address]
+	if !found {
+		s = newReplicationStates()
+		f.states[address] = s
+	}
+
+	return s
+}
+
+// transportKey returns the key identifying the vault server and TLS configuration of a configuration
+func transportKey(c *Config) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%t|%x|%s|%x|%x",
+		c.Address, c.Insecure, sha256.Sum256(c.CACert), c.TLSServerName, sha256.Sum256(c.ClientCert), sha256.Sum256(c.ClientKey))))
+	return hex.EncodeToString(hash[:])
+}
+
+// transport returns the transport to use for the given configuration, creating it if needed
+func (f *ClientFactory) transport(c *Config) (*pooledTransport, error) {
+	key := transportKey(c)
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.evictLocked(time.Now())
+	if t, found := f.transports[key]; found {
+		t.touch()
+		return t, nil
+	}
+
+	tlsConfig, err := newTLSConfig(c)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if f.config.ProxyURL != "" {
+		proxyURL, err := url.Parse(f.config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to parse proxy URL, err=%v", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+
+	t := &pooledTransport{address: c.Address}
+	dialer := &net.Dialer{
+		Timeout:   f.config.DialTimeout,
+		KeepAlive: f.config.KeepAlive,
+	}
+	t.transport = &http.Transport{
+		Proxy: proxy,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			atomic.AddInt64(&t.connections, 1)
+			atomic.AddInt64(&t.openConnections, 1)
+			return &countedConn{Conn: conn, open: &t.openConnections}, nil
+		},
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: f.config.TLSHandshakeTimeout,
+		IdleConnTimeout:     f.config.IdleConnTimeout,
+		MaxIdleConns:        f.config.MaxIdleConns,
+		MaxIdleConnsPerHost: f.config.MaxIdleConnsPerHost,
+		DisableKeepAlives:   f.config.KeepAlive < 0,
+		ForceAttemptHTTP2:   true,
+	}
+	t.touch()
+	f.transports[key] = t
+
+	return t, nil
+}
+
+// evictLocked evicts the transports not used since TransportEvictionTTL, closing their idle connections,
+// and the rate limiters and replication states of the addresses without transport, f.mutex must be held
+func (f *ClientFactory) evictLocked(now time.Time) {
+	addresses := make(map[string]bool)
+	for key, t := range f.transports {
+		if now.Sub(time.Unix(0, atomic.LoadInt64(&t.lastUsed))) < TransportEvictionTTL {
+			addresses[t.address] = true
+			continue
+		}
+		log.V(1).Info("Evicting unused vault transport", "address", t.address)
+		t.transport.CloseIdleConnections()
+		delete(f.transports, key)
+	}
+
+	for address := range f.limiters {
+		if !addresses[address] {
+			delete(f.limiters, address)
+		}
+	}
+	for address := range f.states {
+		if !addresses[address] {
+			delete(f.states, address)
+		}
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *pooledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.touch()
+	atomic.AddInt64(&t.requests, 1)
+	return t.transport.RoundTrip(req)
+}
+
+// touch records that the transport is used
+func (t *pooledTransport) touch() {
+	atomic.StoreInt64(&t.lastUsed, time.Now().UnixNano())
+}
+
+// countedConn is a connection decrementing a counter when closed
+type countedConn struct {
+	net.Conn
+	open      *int64
+	closeOnce sync.Once
+}
+
+// Close closes the connection
+func (c *countedConn) Close() error {
+	c.closeOnce.Do(func() {
+		atomic.AddInt64(c.open, -1)
+	})
+	return c.Conn.Close()
+}
+
+// newClient creates a vault client not logged in using the configuration's client factory
+func (c *Config) newClient() (*vapi.Client, error) {
+	factory := c.ClientFactory
+	if factory == nil {
+		factory = defaultClientFactory
+	}
+	return factory.NewClient(c)
+}
@@ -0,0 +1,164 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newCACert returns a self-signed CA certificate in PEM format
+func newCACert(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() err=%v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() err=%v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestClientFactoryTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	caCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	otherServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer otherServer.Close()
+	otherCACert := newCACert(t)
+
+	base := func() *Config {
+		c := NewConfig(server.URL)
+		c.CACert = caCert
+		return c
+	}
+
+	tests := []struct {
+		name       string
+		modify     func(c *Config)
+		wantShared bool
+	}{
+		{name: "same configuration", modify: func(c *Config) {}, wantShared: true},
+		{name: "other vault namespace", modify: func(c *Config) { c.Namespace = "team-a" }, wantShared: true},
+		{name: "other consistency mode", modify: func(c *Config) { c.Consistency = ConsistencyForwardActive }, wantShared: true},
+		{name: "other address", modify: func(c *Config) { c.Address = otherServer.URL }},
+		{name: "other CA certificate", modify: func(c *Config) { c.CACert = otherCACert }},
+		{name: "insecure", modify: func(c *Config) { c.Insecure = true }},
+		{name: "other TLS server name", modify: func(c *Config) { c.TLSServerName = "vault.example.com" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewClientFactory(DefaultTransportConfig())
+			other := base()
+			tt.modify(other)
+
+			t1, err := f.transport(base())
+			if err != nil {
+				t.Fatalf("transport() err=%v", err)
+			}
+			t2, err := f.transport(other)
+			if err != nil {
+				t.Fatalf("transport() err=%v", err)
+			}
+			if shared := t1 == t2; shared != tt.wantShared {
+				t.Errorf("transport shared=%t, want %t", shared, tt.wantShared)
+			}
+		})
+	}
+}
+
+func TestClientFactoryConnectionsReused(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"ttl": 0}})
+	}))
+	defer server.Close()
+
+	f := NewClientFactory(DefaultTransportConfig())
+	for i := 0; i < 3; i++ {
+		c := NewConfig(server.URL)
+		c.CACert = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+		vclient, err := f.NewClient(c)
+		if err != nil {
+			t.Fatalf("NewClient() err=%v", err)
+		}
+		vclient.SetToken("token")
+		if _, err := vclient.Auth().Token().LookupSelf(); err != nil {
+			t.Fatalf("LookupSelf() err=%v", err)
+		}
+	}
+
+	stats := f.Stats()
+	if len(stats) != 1 {
+		t.Fatalf("transports=%d, want 1", len(stats))
+	}
+	if stats[0].Requests != 3 || stats[0].Connections != 1 {
+		t.Errorf("requests=%d connections=%d, want 3 requests on 1 connection", stats[0].Requests, stats[0].Connections)
+	}
+}
+
+func TestClientFactoryEvict(t *testing.T) {
+	config := DefaultTransportConfig()
+	config.RateLimit = 10
+	f := NewClientFactory(config)
+
+	c := NewConfig("https://vault.example.com")
+	if _, err := f.NewClient(c); err != nil {
+		t.Fatalf("NewClient() err=%v", err)
+	}
+	used := NewConfig("https://vault-2.example.com")
+	if _, err := f.NewClient(used); err != nil {
+		t.Fatalf("NewClient() err=%v", err)
+	}
+
+	// Only the first transport is not used anymore
+	f.mutex.Lock()
+	atomic.StoreInt64(&f.transports[transportKey(c)].lastUsed, time.Now().Add(-TransportEvictionTTL).UnixNano())
+	f.evictLocked(time.Now())
+	_, transportFound := f.transports[transportKey(c)]
+	_, limiterFound := f.limiters[c.Address]
+	_, statesFound := f.states[c.Address]
+	_, usedFound := f.transports[transportKey(used)]
+	f.mutex.Unlock()
+
+	if transportFound || limiterFound || statesFound {
+		t.Errorf("transport=%t limiter=%t states=%t found after eviction", transportFound, limiterFound, statesFound)
+	}
+	if !usedFound {
+		t.Errorf("transport in use has been evicted")
+	}
+}
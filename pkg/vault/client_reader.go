@@ -11,5 +11,5 @@ const (
 
 // Client is an interface to read data from vault
 type Client interface {
-	Read(engine int, kvPath string, secretPath string) (map[string]interface{}, error)
+	Read(engine int, namespace string, kvPath string, secretPath string) (map[string]interface{}, error)
 }
@@ -1,6 +1,7 @@
 package vault
 
 import (
+	"errors"
 	"fmt"
 	"path"
 	"strings"
@@ -13,6 +14,8 @@ var _ Client = (*SimpleClient)(nil)
 // SimpleClient is a simplistic client to connect to vault
 type SimpleClient struct {
 	client *vapi.Client
+	// namespaceClients are copies of client using another vault namespace, indexed by namespace
+	namespaceClients map[string]*vapi.Client
 }
 
 // NewSimpleClient creates a pointer to a SimpleClient struct
@@ -23,33 +26,76 @@ func NewSimpleClient(client *vapi.Client) *SimpleClient {
 }
 
 // Read implem for SimpleClient struct
-func (c *SimpleClient) Read(kvVersion int, kvPath string, secretPath string) (map[string]interface{}, error) {
+// namespace overrides the client's vault namespace if not empty
+func (c *SimpleClient) Read(kvVersion int, namespace string, kvPath string, secretPath string) (map[string]interface{}, error) {
+	client, err := c.NamespaceClient(namespace)
+	if err != nil {
+		return nil, err
+	}
+
 	switch kvVersion {
 	case KvVersion1:
-		sec, err := c.read(path.Join(kvPath, secretPath))
+		sec, err := read(client, path.Join(kvPath, secretPath))
 		if err != nil {
 			return nil, err
 		}
 		return sec.Data, nil
 	case KvVersion2:
-		sec, err := c.read(path.Join(kvPath, "data", secretPath))
+		sec, err := read(client, path.Join(kvPath, "data", secretPath))
 		if err != nil {
 			return nil, err
 		}
 		return sec.Data["data"].(map[string]interface{}), nil
 	case KvVersionAuto:
-		_, version, err := kvPreflightVersionRequest(c.client, kvPath)
+		version, err := mountKvVersion(client, kvPath)
 		if err != nil {
 			return nil, err
 		}
-		return c.Read(version, kvPath, secretPath)
+		secret, err := c.Read(version, namespace, kvPath, secretPath)
+		var wrongVersionErr *WrongVersionError
+		if errors.As(err, &wrongVersionErr) {
+			// The mount may have been upgraded since its version has been cached
+			invalidateMountKvVersion(client, kvPath)
+			if version, err = mountKvVersion(client, kvPath); err != nil {
+				return nil, err
+			}
+			secret, err = c.Read(version, namespace, kvPath, secretPath)
+		}
+		return secret, err
 	default:
 		return nil, fmt.Errorf("unknown version %d", kvVersion)
 	}
 }
 
-func (c *SimpleClient) read(path string) (*vapi.Secret, error) {
-	sec, err := c.client.Logical().Read(path)
+// NamespaceClient returns a client using the given vault namespace, the client itself if namespace is empty
+// The client is copied so that its namespace is not changed for other reconciles using it
+func (c *SimpleClient) NamespaceClient(namespace string) (*vapi.Client, error) {
+	if namespace == "" {
+		return c.client, nil
+	}
+	if client, found := c.namespaceClients[namespace]; found {
+		return client, nil
+	}
+
+	client, err := c.client.Clone()
+	if err != nil {
+		return nil, err
+	}
+	// Clone only copies the configuration
+	client.SetHeaders(c.client.Headers())
+	client.SetToken(c.client.Token())
+	client.SetNamespace(namespace)
+
+	if c.namespaceClients == nil {
+		c.namespaceClients = make(map[string]*vapi.Client)
+	}
+	c.namespaceClients[namespace] = client
+
+	return client, nil
+}
+
+func read(client *vapi.Client, path string) (*vapi.Secret, error) {
+	sec, err := client.Logical().Read(path)
 
 	if err != nil {
 		// An unknown error occurred
@@ -0,0 +1,97 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestSimpleClientNamespace(t *testing.T) {
+	var mutex sync.Mutex
+	var namespaces []string
+	stub := newVaultStub(t, map[string]http.HandlerFunc{
+		"GET /v1/secret/app": func(w http.ResponseWriter, req *http.Request) {
+			mutex.Lock()
+			namespaces = append(namespaces, req.Header.Get("X-Vault-Namespace"))
+			mutex.Unlock()
+			writeJSON(w, http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"password": "s3cr3t"}})
+		},
+	})
+	defer stub.Close()
+
+	c := stub.config()
+	c.Namespace = "root-ns"
+	vclient, err := c.newClient()
+	if err != nil {
+		t.Fatalf("newClient() err=%v", err)
+	}
+	vclient.SetToken("token-1")
+	client := NewSimpleClient(vclient)
+
+	tests := []struct {
+		name      string
+		namespace string
+		want      string
+	}{
+		{name: "configuration's namespace", namespace: "", want: "root-ns"},
+		{name: "overridden namespace", namespace: "team-a", want: "team-a"},
+		{name: "overridden namespace again", namespace: "team-a", want: "team-a"},
+		{name: "another namespace", namespace: "team-b", want: "team-b"},
+		{name: "configuration's namespace after overrides", namespace: "", want: "root-ns"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutex.Lock()
+			namespaces = nil
+			mutex.Unlock()
+
+			data, err := client.Read(KvVersion1, tt.namespace, "secret", "app")
+			if err != nil {
+				t.Fatalf("Read() err=%v", err)
+			}
+			if data["password"] != "s3cr3t" {
+				t.Errorf("Read()=%v, want password s3cr3t", data)
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if len(namespaces) != 1 || namespaces[0] != tt.want {
+				t.Errorf("X-Vault-Namespace=%v, want [%s]", namespaces, tt.want)
+			}
+		})
+	}
+
+	// Namespace clients are reused and keep the token of the client
+	nsClient, err := client.NamespaceClient("team-a")
+	if err != nil {
+		t.Fatalf("NamespaceClient() err=%v", err)
+	}
+	if again, _ := client.NamespaceClient("team-a"); again != nsClient {
+		t.Errorf("NamespaceClient() did not reuse the namespace client")
+	}
+	if nsClient.Token() != "token-1" {
+		t.Errorf("namespace client token=%s, want token-1", nsClient.Token())
+	}
+	for _, req := range stub.received("GET /v1/secret/app") {
+		if req.token != "token-1" {
+			t.Errorf("request sent with token %s, want token-1", req.token)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConsistencyMode defines how reads are made consistent with the previous requests
+// when they are served by Vault Enterprise performance standby nodes
+// https://www.vaultproject.io/docs/enterprise/consistency
+type ConsistencyMode string
+
+const (
+	// ConsistencyBestEffort does not ensure consistency, reads may be stale
+	ConsistencyBestEffort ConsistencyMode = "bestEffort"
+	// ConsistencyForwardActive forwards the requests to the active node when the standby node is not up to date
+	ConsistencyForwardActive ConsistencyMode = "forwardActive"
+	// ConsistencyRetry retries the requests until the standby node is up to date
+	ConsistencyRetry ConsistencyMode = "retry"
+
+	// VaultIndexHeader is the header containing the replication states of vault
+	VaultIndexHeader = "X-Vault-Index"
+	// VaultInconsistentHeader is the header telling vault what to do when a node is not up to date
+	VaultInconsistentHeader = "X-Vault-Inconsistent"
+
+	// ConsistencyMaxRetries is the maximum number of retries of a request until the standby node is up to date
+	ConsistencyMaxRetries = 5
+	// ConsistencyRetryWait is the initial time to wait before retrying, doubled on each retry
+	ConsistencyRetryWait = 50 * time.Millisecond
+)
+
+// replicationStates keeps the latest replication states (X-Vault-Index values) seen from a vault cluster
+// so that next requests are served by nodes at least as up to date. It is safe for concurrent use.
+type replicationStates struct {
+	mutex sync.Mutex
+	// states are indexed by vault cluster ID
+	states map[string]replicationState
+}
+
+// replicationState is a parsed X-Vault-Index value
+type replicationState struct {
+	raw                         string
+	localIndex, replicatedIndex uint64
+}
+
+// newReplicationStates creates a pointer to a replicationStates struct
+func newReplicationStates() *replicationStates {
+	return &replicationStates{
+		states: make(map[string]replicationState),
+	}
+}
+
+// parseReplicationState parses a X-Vault-Index value, formatted as base64("v1:<cluster id>:<local index>:<replicated index>:<hmac>")
+func parseReplicationState(raw string) (string, replicationState, error) {
+	decoded, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return "", replicationState{}, err
+	}
+
+	pieces := strings.Split(string(decoded), ":")
+	if len(pieces) != 5 || pieces[0] != "v1" || pieces[1] == "" {
+		return "", replicationState{}, fmt.Errorf("invalid replication state format")
+	}
+
+	localIndex, err := strconv.ParseUint(pieces[2], 10, 64)
+	if err != nil {
+		return "", replicationState{}, err
+	}
+	replicatedIndex, err := strconv.ParseUint(pieces[3], 10, 64)
+	if err != nil {
+		return "", replicationState{}, err
+	}
+
+	return pieces[1], replicationState{raw: raw, localIndex: localIndex, replicatedIndex: replicatedIndex}, nil
+}
+
+// record records the replication states returned by vault, only keeping the most recent one of each cluster
+func (s *replicationStates) record(values []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, raw := range values {
+		clusterID, state, err := parseReplicationState(raw)
+		if err != nil {
+			log.V(1).Info("Unable to parse vault replication state", "err", err.Error())
+			continue
+		}
+
+		current, found := s.states[clusterID]
+		if !found || (state.localIndex >= current.localIndex && state.replicatedIndex >= current.replicatedIndex) {
+			s.states[clusterID] = state
+		}
+	}
+}
+
+// values returns the replication states to send to vault
+func (s *replicationStates) values() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	values := make([]string, 0, len(s.states))
+	for _, state := range s.states {
+		values = append(values, state.raw)
+	}
+	return values
+}
+
+// consistencyTransport sends the known replication states along with the requests
+// and records the ones returned by vault according to the consistency mode
+type consistencyTransport struct {
+	next   http.RoundTripper
+	mode   ConsistencyMode
+	states *replicationStates
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *consistencyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.mode == "" || t.mode == ConsistencyBestEffort {
+		return t.next.RoundTrip(req)
+	}
+
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	wait := ConsistencyRetryWait
+	for attempt := 0; ; attempt++ {
+		r := cloneRequest(req, body)
+		// An empty index asks vault to return its replication state
+		r.Header.Del(VaultIndexHeader)
+		r.Header.Add(VaultIndexHeader, "")
+		for _, state := range t.states.values() {
+			r.Header.Add(VaultIndexHeader, state)
+		}
+		if t.mode == ConsistencyForwardActive {
+			r.Header.Set(VaultInconsistentHeader, "forward-active-node")
+		} else {
+			r.Header.Set(VaultInconsistentHeader, "fail")
+		}
+
+		resp, err := t.next.RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+		t.states.record(resp.Header[http.CanonicalHeaderKey(VaultIndexHeader)])
+
+		// Node not up to date yet
+		if t.mode != ConsistencyRetry || resp.StatusCode != http.StatusPreconditionFailed || attempt >= ConsistencyMaxRetries {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		log.V(1).Info("Vault node not up to date, retrying", "path", req.URL.Path, "wait", wait.String())
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
@@ -0,0 +1,168 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"testing"
+)
+
+// replicationStateValue returns a X-Vault-Index value
+func replicationStateValue(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestParseReplicationState(t *testing.T) {
+	tests := []struct {
+		name          string
+		raw           string
+		wantClusterID string
+		wantLocal     uint64
+		wantRepl      uint64
+		wantErr       bool
+	}{
+		{name: "valid", raw: replicationStateValue("v1:cluster-a:12:34:hmac"), wantClusterID: "cluster-a", wantLocal: 12, wantRepl: 34},
+		{name: "not base64", raw: "not base64!", wantErr: true},
+		{name: "unknown version", raw: replicationStateValue("v2:cluster-a:12:34:hmac"), wantErr: true},
+		{name: "missing pieces", raw: replicationStateValue("v1:cluster-a:12"), wantErr: true},
+		{name: "empty cluster ID", raw: replicationStateValue("v1::12:34:hmac"), wantErr: true},
+		{name: "invalid local index", raw: replicationStateValue("v1:cluster-a:x:34:hmac"), wantErr: true},
+		{name: "invalid replicated index", raw: replicationStateValue("v1:cluster-a:12:-1:hmac"), wantErr: true},
+		{name: "empty", raw: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clusterID, state, err := parseReplicationState(tt.raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseReplicationState() err=%v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if clusterID != tt.wantClusterID || state.localIndex != tt.wantLocal || state.replicatedIndex != tt.wantRepl || state.raw != tt.raw {
+				t.Errorf("parseReplicationState()=%s %+v, want %s %d %d", clusterID, state, tt.wantClusterID, tt.wantLocal, tt.wantRepl)
+			}
+		})
+	}
+}
+
+func TestReplicationStatesRecord(t *testing.T) {
+	older := replicationStateValue("v1:cluster-a:10:10:hmac")
+	newer := replicationStateValue("v1:cluster-a:11:12:hmac")
+	diverging := replicationStateValue("v1:cluster-a:12:9:hmac")
+	other := replicationStateValue("v1:cluster-b:1:1:hmac")
+
+	tests := []struct {
+		name    string
+		records [][]string
+		want    []string
+	}{
+		{name: "most recent state kept", records: [][]string{{older}, {newer}}, want: []string{newer}},
+		{name: "older state ignored", records: [][]string{{newer}, {older}}, want: []string{newer}},
+		{name: "state not more recent on all indexes ignored", records: [][]string{{newer}, {diverging}}, want: []string{newer}},
+		{name: "one state per cluster", records: [][]string{{older, other}}, want: []string{older, other}},
+		{name: "invalid and empty states ignored", records: [][]string{{"", "invalid", older}}, want: []string{older}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newReplicationStates()
+			for _, values := range tt.records {
+				s.record(values)
+			}
+
+			got := s.values()
+			sort.Strings(got)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("values()=%v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestConsistencyTransport(t *testing.T) {
+	state := replicationStateValue("v1:cluster-a:10:10:hmac")
+
+	tests := []struct {
+		name             string
+		mode             ConsistencyMode
+		statuses         []int
+		wantAttempts     int
+		wantStatus       int
+		wantInconsistent string
+	}{
+		{name: "forward active", mode: ConsistencyForwardActive, statuses: []int{200, 200},
+			wantAttempts: 2, wantStatus: 200, wantInconsistent: "forward-active-node"},
+		{name: "retry until up to date", mode: ConsistencyRetry, statuses: []int{200, 412, 412, 200},
+			wantAttempts: 4, wantStatus: 200, wantInconsistent: "fail"},
+		{name: "best effort", mode: ConsistencyBestEffort, statuses: []int{200, 200},
+			wantAttempts: 2, wantStatus: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				attempt := atomic.AddInt64(&attempts, 1)
+				if attempt > 1 {
+					// The state returned by the first response is sent along with the next requests
+					indexes := req.Header[http.CanonicalHeaderKey(VaultIndexHeader)]
+					found := false
+					for _, index := range indexes {
+						found = found || index == state
+					}
+					if tt.mode != ConsistencyBestEffort && !found {
+						t.Errorf("attempt %d: %s=%v, want %s", attempt, VaultIndexHeader, indexes, state)
+					}
+					if got := req.Header.Get(VaultInconsistentHeader); got != tt.wantInconsistent {
+						t.Errorf("attempt %d: %s=%q, want %q", attempt, VaultInconsistentHeader, got, tt.wantInconsistent)
+					}
+				}
+				w.Header().Set(VaultIndexHeader, state)
+				w.WriteHeader(tt.statuses[attempt-1])
+			}))
+			defer server.Close()
+
+			transport := &consistencyTransport{next: http.DefaultTransport, mode: tt.mode, states: newReplicationStates()}
+			// A first request to get a replication state, then a request sent until it succeeds
+			var resp *http.Response
+			for i := 0; i < 2; i++ {
+				req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+				var err error
+				if resp, err = transport.RoundTrip(req); err != nil {
+					t.Fatalf("RoundTrip() err=%v", err)
+				}
+				resp.Body.Close()
+			}
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status=%d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := atomic.LoadInt64(&attempts); got != int64(tt.wantAttempts) {
+				t.Errorf("attempts=%d, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
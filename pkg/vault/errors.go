@@ -16,7 +16,13 @@ limitations under the License.
 
 package vault
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	vapi "github.com/hashicorp/vault/api"
+)
 
 // KVWarning is the warning returned by the vault API when the K/V path is invalid (wrong version)
 const KVWarning = "Invalid path for a versioned K/V secrets engine."
@@ -40,3 +46,9 @@ type PathNotFound struct {
 func (e *PathNotFound) Error() string {
 	return fmt.Sprintf("Path %s not found", e.Path)
 }
+
+// IsPermissionDenied checks whether an error returned by vault is a permission denied error
+func IsPermissionDenied(err error) bool {
+	var respErr *vapi.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == http.StatusForbidden
+}
@@ -0,0 +1,137 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// HealthCheckTTL is the duration during which the health of a vault server is not checked again
+	HealthCheckTTL = 10 * time.Second
+	// HealthCheckTimeout is the timeout of a vault server's health check
+	HealthCheckTimeout = 5 * time.Second
+)
+
+var (
+	// healthChecks keeps the last health check of each vault server, shared by all reconciles
+	// They are indexed by vault address and TLS configuration (see transportKey) as the result depends on both
+	healthChecks      = make(map[string]healthCheck)
+	healthChecksMutex sync.Mutex
+)
+
+// healthCheck is the result of a vault server's health check
+type healthCheck struct {
+	err  error
+	time time.Time
+}
+
+// SelectAddress sets the address of the configuration to the first healthy address of c.Addresses
+// A server is healthy if it is initialized, unsealed and active or performance standby.
+// Nothing is done if less than two addresses are configured.
+func (c *Config) SelectAddress() error {
+	if len(c.Addresses) < 2 {
+		return nil
+	}
+
+	var errs []string
+	for _, address := range c.Addresses {
+		err := checkHealth(c, address)
+		if err == nil {
+			c.Address = address
+			return nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", address, err))
+	}
+
+	return fmt.Errorf("No healthy vault server available, err=[%s]", strings.Join(errs, "; "))
+}
+
+// MarkUnhealthy marks the vault server of the configuration as unhealthy (e.g. after a connection error)
+// so that another server is selected until its health is checked again
+func MarkUnhealthy(c *Config, err error) {
+	healthChecksMutex.Lock()
+	defer healthChecksMutex.Unlock()
+
+	healthChecks[transportKey(c)] = healthCheck{err: err, time: time.Now()}
+}
+
+// IsConnectionError checks whether an error is due to the vault server not being reachable
+// (i.e. an error of the HTTP transport) as opposed to an error returned by vault or raised by the operator
+func IsConnectionError(err error) bool {
+	var urlErr *url.Error
+	var netErr net.Error
+	return errors.As(err, &urlErr) || errors.As(err, &netErr)
+}
+
+// checkHealth checks the health of a vault server, reusing a recent result
+func checkHealth(c *Config, address string) error {
+	probeConfig := *c
+	probeConfig.Address = address
+	key := transportKey(&probeConfig)
+
+	healthChecksMutex.Lock()
+	check, found := healthChecks[key]
+	healthChecksMutex.Unlock()
+	if found && time.Since(check.time) < HealthCheckTTL {
+		return check.err
+	}
+
+	err := probeHealth(&probeConfig)
+	if err != nil {
+		log.Info("Vault server is not healthy", "address", address, "err", err.Error())
+	}
+
+	healthChecksMutex.Lock()
+	healthChecks[key] = healthCheck{err: err, time: time.Now()}
+	healthChecksMutex.Unlock()
+
+	return err
+}
+
+// probeHealth calls sys/health on the vault server of the configuration
+func probeHealth(c *Config) error {
+	vclient, err := c.newClient()
+	if err != nil {
+		return err
+	}
+	vclient.ClearToken()
+	vclient.SetMaxRetries(0)
+	vclient.SetClientTimeout(HealthCheckTimeout)
+
+	health, err := vclient.Sys().Health()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !health.Initialized:
+		return errors.New("not initialized")
+	case health.Sealed:
+		return errors.New("sealed")
+	case health.Standby && !health.PerformanceStandby:
+		return errors.New("standby")
+	}
+
+	return nil
+}
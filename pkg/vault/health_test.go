@@ -0,0 +1,166 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+const routeHealth = "GET /v1/sys/health"
+
+// resetHealthChecks empties the health checks cache
+func resetHealthChecks() {
+	healthChecksMutex.Lock()
+	defer healthChecksMutex.Unlock()
+	healthChecks = make(map[string]healthCheck)
+}
+
+func TestIsConnectionError(t *testing.T) {
+	urlErr := &url.Error{Op: "Get", URL: "https://vault:8200/v1/secret/foo", Err: errors.New("connection refused")}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "no error", err: nil, want: false},
+		{name: "transport error", err: urlErr, want: true},
+		{name: "wrapped transport error", err: fmt.Errorf("Unable to read, err=%w", urlErr), want: true},
+		{name: "network error", err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, want: true},
+		{name: "vault error", err: &vapi.ResponseError{StatusCode: http.StatusServiceUnavailable}, want: false},
+		{name: "wrong kv version", err: &WrongVersionError{Message: "wrong version"}, want: false},
+		{name: "path not found", err: &PathNotFound{Path: "secret/foo"}, want: false},
+		{name: "invalid kv version", err: errors.New("unknown version"), want: false},
+		{name: "invalid plaintext", err: errors.New("Unable to decode plaintext, err=illegal base64 data"), want: false},
+		{name: "no lease", err: errors.New("No lease returned"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsConnectionError(tt.err); got != tt.want {
+				t.Errorf("IsConnectionError()=%t, want %t", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("unreachable server", func(t *testing.T) {
+		stub := newVaultStub(t, nil)
+		stub.Close()
+		vclient, err := stub.config().newClient()
+		if err != nil {
+			t.Fatalf("newClient() err=%v", err)
+		}
+		if _, err := vclient.Logical().Read("secret/foo"); !IsConnectionError(err) {
+			t.Errorf("IsConnectionError(%v)=false, want true", err)
+		}
+	})
+}
+
+func TestSelectAddress(t *testing.T) {
+	health := func(sealed, standby, perfStandby bool) *vaultStub {
+		return newVaultStub(t, map[string]http.HandlerFunc{
+			routeHealth: respond(http.StatusOK, map[string]interface{}{
+				"initialized": true, "sealed": sealed, "standby": standby, "performance_standby": perfStandby,
+			}),
+		})
+	}
+	active := health(false, false, false)
+	defer active.Close()
+	other := health(false, false, false)
+	defer other.Close()
+	sealed := health(true, false, false)
+	defer sealed.Close()
+	standby := health(false, true, false)
+	defer standby.Close()
+	perfStandby := health(false, true, true)
+	defer perfStandby.Close()
+	unreachable := newVaultStub(t, nil)
+	unreachable.Close()
+
+	tests := []struct {
+		name      string
+		addresses []*vaultStub
+		unhealthy *vaultStub
+		want      *vaultStub
+		wantErr   bool
+		wantProbe []*vaultStub
+	}{
+		{name: "single address not checked", addresses: []*vaultStub{sealed}, want: sealed},
+		{name: "first healthy address", addresses: []*vaultStub{active, other}, want: active, wantProbe: []*vaultStub{active}},
+		{name: "unreachable server skipped", addresses: []*vaultStub{unreachable, active}, want: active, wantProbe: []*vaultStub{active}},
+		{name: "sealed and standby servers skipped", addresses: []*vaultStub{sealed, standby, active}, want: active,
+			wantProbe: []*vaultStub{sealed, standby, active}},
+		{name: "performance standby accepted", addresses: []*vaultStub{perfStandby, active}, want: perfStandby,
+			wantProbe: []*vaultStub{perfStandby}},
+		{name: "server marked unhealthy skipped", addresses: []*vaultStub{active, other}, unhealthy: active, want: other,
+			wantProbe: []*vaultStub{other}},
+		{name: "no healthy server", addresses: []*vaultStub{unreachable, sealed}, wantErr: true, wantProbe: []*vaultStub{sealed}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetHealthChecks()
+			defer resetHealthChecks()
+			probes := make(map[*vaultStub]int)
+			for _, stub := range tt.addresses {
+				probes[stub] = len(stub.received(routeHealth))
+			}
+
+			c := tt.addresses[0].config()
+			c.Addresses = nil
+			for _, stub := range tt.addresses {
+				c.Addresses = append(c.Addresses, stub.URL)
+			}
+			if tt.unhealthy != nil {
+				unhealthy := *c
+				unhealthy.Address = tt.unhealthy.URL
+				MarkUnhealthy(&unhealthy, errors.New("connection refused"))
+			}
+
+			// The result is cached, servers are only probed once
+			for i := 0; i < 2; i++ {
+				err := c.SelectAddress()
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("SelectAddress() err=%v, wantErr %t", err, tt.wantErr)
+				}
+				if !tt.wantErr && c.Address != tt.want.URL {
+					t.Errorf("Address=%s, want %s", c.Address, tt.want.URL)
+				}
+			}
+
+			wantProbes := make(map[*vaultStub]int)
+			for _, stub := range tt.wantProbe {
+				wantProbes[stub]++
+			}
+			for _, stub := range tt.addresses {
+				if stub == unreachable {
+					continue
+				}
+				if got := len(stub.received(routeHealth)) - probes[stub]; got != wantProbes[stub] {
+					t.Errorf("%s probes=%d, want %d", stub.URL, got, wantProbes[stub])
+				}
+			}
+		})
+	}
+}
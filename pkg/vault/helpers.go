@@ -1,11 +1,62 @@
 package vault
 
 import (
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/hashicorp/vault/api"
 )
 
+// jwtSubject returns the issuer and subject claims of a jwt token without verifying it
+// The token itself is returned if it cannot be decoded
+func jwtSubject(jwt string) string {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return jwt
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return jwt
+	}
+
+	claims := struct {
+		Issuer  string `json:"iss"`
+		Subject string `json:"sub"`
+	}{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims.Subject == "" {
+		return jwt
+	}
+
+	return claims.Issuer + "/" + claims.Subject
+}
+
+// sourceSubject returns the subject of the tokens returned by a JWTSource if set, the one of the given jwt token otherwise
+func sourceSubject(jwt, subject string) string {
+	if subject != "" {
+		return subject
+	}
+	return jwtSubject(jwt)
+}
+
+// sourceJWT returns the jwt token to login with, getting it from the source if set
+func sourceJWT(jwt string, source JWTSource) (string, error) {
+	if source != nil {
+		var err error
+		if jwt, err = source(); err != nil {
+			return "", err
+		}
+	}
+
+	if jwt == "" {
+		return "", fmt.Errorf("Token is empty, please provide a valid jwt token")
+	}
+	return jwt, nil
+}
+
 // https://github.com/hashicorp/vault/blob/d8995bfe42d50a13e8f31b686010b0990c5c9b10/command/kv_helpers.go#L44
 func kvPreflightVersionRequest(client *api.Client, path string) (string, int, error) {
 	// We don't want to use a wrapping call here so save any custom value and
@@ -0,0 +1,92 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"fmt"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+var _ AuthProvider = (*JWTProvider)(nil)
+
+// JWTSource returns the jwt token to use for the authentication (e.g. requested for a service account)
+// It is called on login only, so that no token is created while a previous login is reused
+type JWTSource func() (string, error)
+
+// JWTProvider is a provider to authenticate using the Vault JWT/OIDC Auth Method plugin
+// https://www.vaultproject.io/docs/auth/jwt
+type JWTProvider struct {
+	// Path is the mount path of the auth method used to call the login URL
+	Path string
+	// Role to use for the authentication
+	Role string
+	// JWT token to use for the authentication
+	jwt string
+	// source returns the jwt token on login if set, subject identifies its tokens
+	source  JWTSource
+	subject string
+}
+
+// NewJWTProvider creates a pointer to a JWTProvider struct
+func NewJWTProvider(path, role, jwt string) *JWTProvider {
+	return &JWTProvider{
+		Path: path,
+		Role: role,
+		jwt:  jwt,
+	}
+}
+
+// SetJWTSource sets the source of the jwt token to use for the authentication instead of a token given upfront
+// The subject is the one of the tokens returned by the source (e.g. system:serviceaccount:<namespace>:<name>)
+func (j *JWTProvider) SetJWTSource(subject string, source JWTSource) {
+	j.subject = subject
+	j.source = source
+}
+
+// Identity returns the role and the subject of the jwt token
+func (j JWTProvider) Identity() string {
+	return fmt.Sprintf("jwt:%s:%s:%s", j.Path, j.Role, sourceSubject(j.jwt, j.subject))
+}
+
+// Login authenticates to the configured vault server
+func (j JWTProvider) Login(c *Config) (*vapi.Client, error) {
+	reqLogger := log.WithValues("func", "JWTProvider.Login")
+	reqLogger.Info("Authenticating using JWT auth method")
+
+	jwt, err := sourceJWT(j.jwt, j.source)
+	if err != nil {
+		return nil, err
+	}
+
+	vclient, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{
+		"role": j.Role,
+		"jwt":  jwt,
+	}
+	s, err := vclient.Logical().Write(fmt.Sprintf("auth/%s/login", j.Path), data)
+	if err != nil {
+		return nil, err
+	}
+
+	vclient.SetToken(s.Auth.ClientToken)
+	return vclient, nil
+}
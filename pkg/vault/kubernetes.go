@@ -17,9 +17,7 @@ limitations under the License.
 package vault
 
 import (
-	"crypto/tls"
 	"fmt"
-	"net/http"
 
 	vapi "github.com/hashicorp/vault/api"
 )
@@ -37,6 +35,9 @@ type KubernetesProvider struct {
 	Cluster string
 	// JWT token to use for the authentication
 	jwt string
+	// source returns the jwt token on login if set, subject identifies its tokens
+	source  JWTSource
+	subject string
 }
 
 // NewKubernetesProvider creates a new KubernetesProvider object
@@ -53,34 +54,37 @@ func (k *KubernetesProvider) SetJWT(jwt string) {
 	k.jwt = jwt
 }
 
+// SetJWTSource sets the source of the jwt token to use for the authentication instead of a token given upfront
+// The subject is the one of the tokens returned by the source (e.g. system:serviceaccount:<namespace>:<name>)
+func (k *KubernetesProvider) SetJWTSource(subject string, source JWTSource) {
+	k.subject = subject
+	k.source = source
+}
+
+// Identity returns the role and the subject of the jwt token
+// The token itself is not used as a new one is requested for each login
+func (k KubernetesProvider) Identity() string {
+	return fmt.Sprintf("kubernetes:%s:%s:%s", k.Cluster, k.Role, sourceSubject(k.jwt, k.subject))
+}
+
 // Login - godoc
 func (k KubernetesProvider) Login(c *Config) (*vapi.Client, error) {
 	reqLogger := log.WithValues("func", "KubernetesProvider.Login")
 	reqLogger.Info("Authenticating using Kubernetes auth method")
 
-	if k.jwt == "" {
-		return nil, fmt.Errorf("Token is empty, please provide a valid jwt token")
-	}
-
-	config := vapi.DefaultConfig()
-	config.Address = c.Address
-	config.HttpClient.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: c.Insecure},
-	}
-
-	vclient, err := vapi.NewClient(config)
+	jwt, err := sourceJWT(k.jwt, k.source)
 	if err != nil {
 		return nil, err
 	}
 
-	vaultNamespace := c.Namespace
-	if vaultNamespace != "" {
-		vclient.SetNamespace(vaultNamespace)
+	vclient, err := c.newClient()
+	if err != nil {
+		return nil, err
 	}
 
 	data := map[string]interface{}{
 		"role": k.Role,
-		"jwt":  k.jwt,
+		"jwt":  jwt,
 	}
 	s, err := vclient.Logical().Write(fmt.Sprintf("auth/%s/login", k.Cluster), data)
 	if err != nil {
@@ -0,0 +1,284 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+const (
+	// LeaseRenewThreshold is the fraction of a lease's duration after which the lease is renewed
+	LeaseRenewThreshold = 2.0 / 3.0
+	// DefaultLeaseGracePeriod is the default time to wait before revoking rotated credentials
+	DefaultLeaseGracePeriod = 5 * time.Minute
+)
+
+// LeaseManager keeps the dynamic credentials (e.g. database credentials) read by owners to reuse them across reconciles.
+// Leases are renewed once LeaseRenewThreshold of their duration has passed. When a lease cannot be renewed
+// for its whole duration anymore (e.g. max TTL reached), new credentials are read and the previous lease
+// is revoked after a grace period once the owner has committed the new credentials (see Commit),
+// letting the workloads pick up the new credentials.
+// It is safe for concurrent use, reads of different credentials do not wait for each other.
+type LeaseManager struct {
+	// mutex protects the maps and the leases of the slots
+	mutex sync.Mutex
+	// leases are indexed by owner, then by vault server, namespace and path
+	leases map[string]map[string]*leaseSlot
+	// rotated are the leases replaced or not used anymore, indexed by owner, revoked when the owner commits
+	rotated map[string][]rotatedLease
+	// revoking are the leases scheduled for revocation
+	revoking map[*lease]bool
+}
+
+// leaseSlot holds the current lease of credentials read by an owner
+type leaseSlot struct {
+	// mutex serializes the reads of the credentials, it is held during the requests to vault
+	mutex sync.Mutex
+	// lease is the current lease, nil if none, it is replaced (never modified) with both mutexes held
+	lease *lease
+	// used is the last time the credentials have been read, m.mutex must be held
+	used time.Time
+	// gracePeriod is the grace period of the last read, used to revoke the lease when not used anymore, m.mutex must be held
+	gracePeriod time.Duration
+}
+
+// lease is a lease of dynamic credentials
+type lease struct {
+	id        string
+	data      map[string]interface{}
+	duration  time.Duration
+	renewable bool
+	renewAt   time.Time
+	// client is the client used to read the credentials
+	client *vapi.Client
+	// token is the token used to read the credentials, leases are revoked along with their token
+	token string
+}
+
+// rotatedLease is a lease to revoke after a delay once the owner has committed
+type rotatedLease struct {
+	lease *lease
+	delay time.Duration
+}
+
+// NewLeaseManager creates a pointer to a LeaseManager struct
+func NewLeaseManager() *LeaseManager {
+	return &LeaseManager{
+		leases:   make(map[string]map[string]*leaseSlot),
+		rotated:  make(map[string][]rotatedLease),
+		revoking: make(map[*lease]bool),
+	}
+}
+
+// Read returns the dynamic credentials read from path (e.g. database/creds/my-role), reusing, renewing
+// or rotating the current ones if any. Rotated credentials are revoked after gracePeriod once committed.
+func (m *LeaseManager) Read(owner string, client *vapi.Client, path string, gracePeriod time.Duration) (map[string]interface{}, error) {
+	reqLogger := log.WithValues("func", "LeaseManager.Read", "owner", owner, "path", path)
+	key := mountsServer(client) + "|" + path
+	now := time.Now()
+
+	m.mutex.Lock()
+	if m.leases[owner] == nil {
+		m.leases[owner] = make(map[string]*leaseSlot)
+	}
+	slot := m.leases[owner][key]
+	if slot == nil {
+		slot = &leaseSlot{}
+		m.leases[owner][key] = slot
+	}
+	slot.used = now
+	slot.gracePeriod = gracePeriod
+	m.mutex.Unlock()
+
+	slot.mutex.Lock()
+	defer slot.mutex.Unlock()
+
+	l := slot.lease
+	switch {
+	case l == nil:
+		reqLogger.Info("Reading dynamic credentials")
+	case l.token != client.Token():
+		reqLogger.Info("Vault token changed, rotating dynamic credentials", "leaseID", l.id)
+	case now.Before(l.renewAt):
+		return l.data, nil
+	case !l.renewable:
+		reqLogger.Info("Lease is not renewable, rotating dynamic credentials", "leaseID", l.id)
+	default:
+		secret, err := client.Sys().Renew(l.id, int(l.duration.Seconds()))
+		if err == nil && secret != nil && time.Duration(secret.LeaseDuration)*time.Second >= l.duration {
+			reqLogger.Info("Lease renewed", "leaseID", l.id)
+			renewed := *l
+			renewed.renewAt = now.Add(time.Duration(float64(l.duration) * LeaseRenewThreshold))
+			m.setLease(slot, &renewed)
+			return l.data, nil
+		}
+		if err != nil {
+			reqLogger.Info("Unable to renew lease, rotating dynamic credentials", "leaseID", l.id, "err", err.Error())
+		} else {
+			// The lease will expire before its whole duration (max TTL reached)
+			reqLogger.Info("Lease max TTL reached, rotating dynamic credentials", "leaseID", l.id)
+		}
+	}
+
+	secret, err := client.Logical().Read(path)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, &PathNotFound{path}
+	}
+	if secret.LeaseID == "" {
+		return nil, fmt.Errorf("No lease returned by vault for %s", path)
+	}
+
+	duration := time.Duration(secret.LeaseDuration) * time.Second
+	m.setLease(slot, &lease{
+		id:        secret.LeaseID,
+		data:      secret.Data,
+		duration:  duration,
+		renewable: secret.Renewable,
+		renewAt:   now.Add(time.Duration(float64(duration) * LeaseRenewThreshold)),
+		client:    client,
+		token:     client.Token(),
+	})
+	if l != nil {
+		m.mutex.Lock()
+		m.rotated[owner] = append(m.rotated[owner], rotatedLease{lease: l, delay: gracePeriod})
+		m.mutex.Unlock()
+	}
+	reqLogger.Info("Dynamic credentials read", "leaseID", secret.LeaseID, "ttl", duration.String())
+
+	return secret.Data, nil
+}
+
+// Commit revokes, after their grace period, the leases of the owner rotated or not used anymore
+// It has to be called once the current credentials of the owner are in use (e.g. written to a secret)
+// so that the previous ones are not revoked while still in use.
+func (m *LeaseManager) Commit(owner string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, r := range m.rotated[owner] {
+		m.revokeLocked(r.lease, r.delay)
+	}
+	delete(m.rotated, owner)
+}
+
+// NextRenewal returns the next time a lease of the owner has to be renewed, zero if the owner has no lease
+func (m *LeaseManager) NextRenewal(owner string) time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var next time.Time
+	for _, slot := range m.leases[owner] {
+		if slot.lease != nil && (next.IsZero() || slot.lease.renewAt.Before(next)) {
+			next = slot.lease.renewAt
+		}
+	}
+
+	return next
+}
+
+// HasLeases checks whether leases not expired nor revoked may have been created with the given token
+// Such a token must not be revoked as vault would revoke the leases along with it
+func (m *LeaseManager) HasLeases(token string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, slots := range m.leases {
+		for _, slot := range slots {
+			if slot.lease != nil && slot.lease.token == token {
+				return true
+			}
+		}
+	}
+	for _, rotated := range m.rotated {
+		for _, r := range rotated {
+			if r.lease.token == token {
+				return true
+			}
+		}
+	}
+	for l := range m.revoking {
+		if l.token == token {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ReleaseUnused schedules the revocation of the leases of the owner which have not been read since the given time
+// (e.g. credentials not referenced anymore by a custom resource), they are revoked after the grace period of their
+// last read (DefaultLeaseGracePeriod if none) once the owner commits, as workloads may still use them
+func (m *LeaseManager) ReleaseUnused(owner string, since time.Time) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key, slot := range m.leases[owner] {
+		if slot.used.Before(since) {
+			if slot.lease != nil {
+				delay := slot.gracePeriod
+				if delay == 0 {
+					delay = DefaultLeaseGracePeriod
+				}
+				m.rotated[owner] = append(m.rotated[owner], rotatedLease{lease: slot.lease, delay: delay})
+			}
+			delete(m.leases[owner], key)
+		}
+	}
+}
+
+// Release forgets the leases of the owner (e.g. deleted custom resource)
+// Leases are not revoked as the credentials may still be used, they expire at the end of their TTL.
+func (m *LeaseManager) Release(owner string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.leases, owner)
+	delete(m.rotated, owner)
+}
+
+// setLease sets the current lease of a slot, slot.mutex must be held
+func (m *LeaseManager) setLease(slot *leaseSlot, l *lease) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	slot.lease = l
+}
+
+// revokeLocked revokes a lease after a delay, in the background, m.mutex must be held
+func (m *LeaseManager) revokeLocked(l *lease, delay time.Duration) {
+	m.revoking[l] = true
+	time.AfterFunc(delay, func() {
+		defer func() {
+			m.mutex.Lock()
+			delete(m.revoking, l)
+			m.mutex.Unlock()
+		}()
+
+		if err := l.client.Sys().Revoke(l.id); err != nil {
+			log.Info("Unable to revoke lease", "leaseID", l.id, "err", err.Error())
+			return
+		}
+		log.Info("Lease revoked", "leaseID", l.id)
+	})
+}
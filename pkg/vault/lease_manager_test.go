@@ -0,0 +1,295 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+const (
+	credsPath       = "database/creds/my-role"
+	routeCreds      = "GET /v1/" + credsPath
+	routeLeaseRenew = "PUT /v1/sys/leases/renew"
+	leaseDuration   = 3600
+)
+
+// newLeaseStub starts a vault stub returning new credentials (lease-1, lease-2, etc.) on each read
+// and renewing leases for renewedDuration seconds
+func newLeaseStub(t *testing.T, renewable bool, renewedDuration int) *vaultStub {
+	var reads int64
+	handlers := map[string]http.HandlerFunc{
+		routeCreds: func(w http.ResponseWriter, req *http.Request) {
+			n := atomic.AddInt64(&reads, 1)
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"lease_id":       fmt.Sprintf("lease-%d", n),
+				"lease_duration": leaseDuration,
+				"renewable":      renewable,
+				"data":           map[string]interface{}{"username": fmt.Sprintf("user-%d", n)},
+			})
+		},
+		routeLeaseRenew: respond(http.StatusOK, map[string]interface{}{"lease_duration": renewedDuration, "renewable": renewable}),
+	}
+	for i := 1; i <= 3; i++ {
+		handlers[fmt.Sprintf("PUT /v1/sys/leases/revoke/lease-%d", i)] = respond(http.StatusNoContent, nil)
+	}
+	return newVaultStub(t, handlers)
+}
+
+// expireLeases sets the renewal time of the leases of the owner in the past
+func expireLeases(m *LeaseManager, owner string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, slot := range m.leases[owner] {
+		expired := *slot.lease
+		expired.renewAt = time.Now().Add(-time.Second)
+		slot.lease = &expired
+	}
+}
+
+// waitRevoked waits for the revocation of the given leases, in the background
+func waitRevoked(stub *vaultStub, ids ...string) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var revoked []string
+		for i := 1; i <= 3; i++ {
+			id := fmt.Sprintf("lease-%d", i)
+			if len(stub.received("PUT /v1/sys/leases/revoke/"+id)) > 0 {
+				revoked = append(revoked, id)
+			}
+		}
+		if len(revoked) >= len(ids) || time.Now().After(deadline) {
+			return revoked
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeaseManagerRead(t *testing.T) {
+	tests := []struct {
+		name            string
+		renewable       bool
+		renewedDuration int
+		expire          bool
+		changeToken     bool
+		wantUsername    string
+		wantReads       int
+		wantRenewals    int
+		wantRevoked     []string
+	}{
+		{name: "credentials reused until renewal time", renewable: true, renewedDuration: leaseDuration,
+			wantUsername: "user-1", wantReads: 1, wantRenewals: 0},
+		{name: "lease renewed", renewable: true, renewedDuration: leaseDuration, expire: true,
+			wantUsername: "user-1", wantReads: 1, wantRenewals: 1},
+		{name: "credentials rotated when max TTL is reached", renewable: true, renewedDuration: leaseDuration / 2, expire: true,
+			wantUsername: "user-2", wantReads: 2, wantRenewals: 1, wantRevoked: []string{"lease-1"}},
+		{name: "credentials rotated when lease is not renewable", renewable: false, expire: true,
+			wantUsername: "user-2", wantReads: 2, wantRenewals: 0, wantRevoked: []string{"lease-1"}},
+		{name: "credentials rotated when token changes", renewable: true, renewedDuration: leaseDuration, changeToken: true,
+			wantUsername: "user-2", wantReads: 2, wantRenewals: 0, wantRevoked: []string{"lease-1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newLeaseStub(t, tt.renewable, tt.renewedDuration)
+			defer stub.Close()
+			vclient, err := stub.config().newClient()
+			if err != nil {
+				t.Fatalf("newClient() err=%v", err)
+			}
+			vclient.SetToken("token-1")
+
+			m := NewLeaseManager()
+			if _, err := m.Read("ns/cr", vclient, credsPath, 0); err != nil {
+				t.Fatalf("Read() err=%v", err)
+			}
+			m.Commit("ns/cr")
+
+			if tt.expire {
+				expireLeases(m, "ns/cr")
+			}
+			if tt.changeToken {
+				vclient, _ = vclient.Clone()
+				vclient.SetToken("token-2")
+			}
+			data, err := m.Read("ns/cr", vclient, credsPath, 0)
+			if err != nil {
+				t.Fatalf("Read() err=%v", err)
+			}
+
+			if data["username"] != tt.wantUsername {
+				t.Errorf("username=%v, want %s", data["username"], tt.wantUsername)
+			}
+			if got := len(stub.received(routeCreds)); got != tt.wantReads {
+				t.Errorf("reads=%d, want %d", got, tt.wantReads)
+			}
+			if got := len(stub.received(routeLeaseRenew)); got != tt.wantRenewals {
+				t.Errorf("renewals=%d, want %d", got, tt.wantRenewals)
+			}
+
+			// Rotated leases are only revoked once committed
+			if revoked := waitRevoked(stub); len(revoked) != 0 {
+				t.Errorf("revoked=%v before Commit()", revoked)
+			}
+			m.Commit("ns/cr")
+			if revoked := waitRevoked(stub, tt.wantRevoked...); len(revoked) != len(tt.wantRevoked) {
+				t.Errorf("revoked=%v, want %v", revoked, tt.wantRevoked)
+			}
+		})
+	}
+}
+
+func TestLeaseManagerReleaseUnused(t *testing.T) {
+	tests := []struct {
+		name        string
+		gracePeriod time.Duration
+		wantRevoked bool
+	}{
+		{name: "revoked after the grace period", gracePeriod: 200 * time.Millisecond, wantRevoked: true},
+		{name: "default grace period", gracePeriod: 0, wantRevoked: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newLeaseStub(t, true, leaseDuration)
+			defer stub.Close()
+			vclient, err := stub.config().newClient()
+			if err != nil {
+				t.Fatalf("newClient() err=%v", err)
+			}
+			vclient.SetToken("token-1")
+
+			m := NewLeaseManager()
+			if _, err := m.Read("ns/cr", vclient, credsPath, tt.gracePeriod); err != nil {
+				t.Fatalf("Read() err=%v", err)
+			}
+
+			m.ReleaseUnused("ns/cr", time.Now().Add(time.Second))
+			if !m.NextRenewal("ns/cr").IsZero() {
+				t.Errorf("NextRenewal() not zero for an owner without lease")
+			}
+			m.Commit("ns/cr")
+
+			// Workloads may still use the credentials during the grace period
+			time.Sleep(tt.gracePeriod / 2)
+			if revoked := waitRevoked(stub); len(revoked) != 0 {
+				t.Errorf("revoked=%v before the grace period", revoked)
+			}
+			if !m.HasLeases("token-1") {
+				t.Errorf("HasLeases()=false before the unused lease is revoked")
+			}
+			if !tt.wantRevoked {
+				return
+			}
+			if revoked := waitRevoked(stub, "lease-1"); len(revoked) != 1 {
+				t.Errorf("revoked=%v, want [lease-1]", revoked)
+			}
+		})
+	}
+}
+
+func TestLeaseManagerHasLeases(t *testing.T) {
+	stub := newLeaseStub(t, true, leaseDuration)
+	defer stub.Close()
+	newClient := func(token string) *vapi.Client {
+		vclient, err := stub.config().newClient()
+		if err != nil {
+			t.Fatalf("newClient() err=%v", err)
+		}
+		vclient.SetToken(token)
+		return vclient
+	}
+
+	m := NewLeaseManager()
+	if _, err := m.Read("ns/a", newClient("token-a"), credsPath, time.Hour); err != nil {
+		t.Fatalf("Read() err=%v", err)
+	}
+	// Rotated lease waiting for its grace period
+	if _, err := m.Read("ns/b", newClient("token-b"), credsPath, time.Hour); err != nil {
+		t.Fatalf("Read() err=%v", err)
+	}
+	if _, err := m.Read("ns/b", newClient("token-c"), credsPath, time.Hour); err != nil {
+		t.Fatalf("Read() err=%v", err)
+	}
+	m.Commit("ns/b")
+
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{token: "token-a", want: true},
+		{token: "token-b", want: true},
+		{token: "token-c", want: true},
+		{token: "token-d", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			if got := m.HasLeases(tt.token); got != tt.want {
+				t.Errorf("HasLeases()=%t, want %t", got, tt.want)
+			}
+		})
+	}
+
+	m.Release("ns/a")
+	if m.HasLeases("token-a") {
+		t.Errorf("HasLeases()=true for a released owner")
+	}
+}
+
+func TestTokenManagerKeepsTokensWithLeases(t *testing.T) {
+	stub := newTokenStub(t, 3600, false)
+	defer stub.Close()
+	stub.handlers[routeCreds] = respond(http.StatusOK, map[string]interface{}{
+		"lease_id": "lease-1", "lease_duration": leaseDuration, "renewable": true,
+		"data": map[string]interface{}{"username": "user-1"},
+	})
+
+	leases := NewLeaseManager()
+	m := NewTokenManager()
+	m.SetLeaseManager(leases)
+	c := stub.config()
+	p := NewAppRoleProvider("approle", "role-id", "secret-id")
+
+	vclient, err := m.Client("ns/a", c, p)
+	if err != nil {
+		t.Fatalf("Client() err=%v", err)
+	}
+	if _, err := leases.Read("ns/a", vclient, credsPath, 0); err != nil {
+		t.Fatalf("Read() err=%v", err)
+	}
+
+	// The token is kept as long as leases created with it are in use
+	m.Release("ns/a")
+	if got := len(stub.received(routeRevokeSelf)); got != 0 {
+		t.Errorf("revocations=%d while leases are in use, want 0", got)
+	}
+
+	leases.Release("ns/a")
+	if _, err := m.Client("ns/a", c, p); err != nil {
+		t.Fatalf("Client() err=%v", err)
+	}
+	m.RevokeAll()
+	if got := len(stub.received(routeRevokeSelf)); got != 1 {
+		t.Errorf("revocations=%d once leases are released, want 1", got)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+// MountCacheTTL is the duration during which the KV version of a mount is not detected again
+const MountCacheTTL = 5 * time.Minute
+
+var (
+	// mounts keeps the KV mounts detected, shared by all reconciles
+	// They are indexed by vault address and namespace, then by the KV path they were detected from
+	mounts      = make(map[string]map[string]mount)
+	mountsMutex sync.Mutex
+)
+
+// mount is the metadata of a KV mount
+type mount struct {
+	// path is the path of the mount with a trailing slash, empty if unknown
+	path    string
+	version int
+	time    time.Time
+}
+
+// mountKvVersion returns the KV version of the mount containing kvPath, detecting it if not cached
+func mountKvVersion(client *vapi.Client, kvPath string) (int, error) {
+	server := mountsServer(client)
+	kvPath = strings.Trim(kvPath, "/")
+
+	mountsMutex.Lock()
+	m, found := lookupMount(server, kvPath)
+	mountsMutex.Unlock()
+	if found {
+		return m.version, nil
+	}
+
+	mountPath, version, err := kvPreflightVersionRequest(client, kvPath)
+	if err != nil {
+		return 0, err
+	}
+	log.V(1).Info("KV version detected", "kvPath", kvPath, "mount", mountPath, "version", version)
+
+	mountsMutex.Lock()
+	defer mountsMutex.Unlock()
+	if mounts[server] == nil {
+		mounts[server] = make(map[string]mount)
+	}
+	mounts[server][kvPath] = mount{path: mountPath, version: version, time: time.Now()}
+
+	return version, nil
+}
+
+// invalidateMountKvVersion removes the mount containing kvPath from the cache (e.g. after a WrongVersionError
+// because the mount has been upgraded)
+func invalidateMountKvVersion(client *vapi.Client, kvPath string) {
+	server := mountsServer(client)
+	kvPath = strings.Trim(kvPath, "/")
+
+	mountsMutex.Lock()
+	defer mountsMutex.Unlock()
+
+	m, found := lookupMount(server, kvPath)
+	if !found {
+		return
+	}
+	for p, other := range mounts[server] {
+		if p == kvPath || (m.path != "" && other.path == m.path) {
+			delete(mounts[server], p)
+		}
+	}
+}
+
+// lookupMount returns the valid cached mount containing kvPath, mountsMutex must be held
+// A mount detected from another KV path can be used as long as kvPath is located under it
+func lookupMount(server, kvPath string) (mount, bool) {
+	if m, found := mounts[server][kvPath]; found && time.Since(m.time) < MountCacheTTL {
+		return m, true
+	}
+
+	for _, m := range mounts[server] {
+		if m.path != "" && strings.HasPrefix(kvPath+"/", m.path) && time.Since(m.time) < MountCacheTTL {
+			return m, true
+		}
+	}
+
+	return mount{}, false
+}
+
+// mountsServer returns the key identifying the vault server and namespace of a client
+func mountsServer(client *vapi.Client) string {
+	return client.Address() + "|" + client.Headers().Get("X-Vault-Namespace")
+}
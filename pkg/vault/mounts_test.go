@@ -0,0 +1,140 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetMounts empties the mount cache
+func resetMounts() {
+	mountsMutex.Lock()
+	defer mountsMutex.Unlock()
+	mounts = make(map[string]map[string]mount)
+}
+
+func TestLookupMount(t *testing.T) {
+	const server = "https://vault:8200|"
+	expired := time.Now().Add(-2 * MountCacheTTL)
+
+	tests := []struct {
+		name        string
+		cached      map[string]map[string]mount
+		server      string
+		kvPath      string
+		wantFound   bool
+		wantVersion int
+	}{
+		{name: "exact match", kvPath: "secret/app",
+			cached:    map[string]map[string]mount{server: {"secret/app": {path: "secret/", version: 2, time: time.Now()}}},
+			wantFound: true, wantVersion: 2},
+		{name: "path located under a known mount", kvPath: "secret/other/app",
+			cached:    map[string]map[string]mount{server: {"secret/app": {path: "secret/", version: 2, time: time.Now()}}},
+			wantFound: true, wantVersion: 2},
+		{name: "mount path itself", kvPath: "secret",
+			cached:    map[string]map[string]mount{server: {"secret/app": {path: "secret/", version: 2, time: time.Now()}}},
+			wantFound: true, wantVersion: 2},
+		{name: "path sharing a prefix with a mount", kvPath: "secretive/app",
+			cached: map[string]map[string]mount{server: {"secret/app": {path: "secret/", version: 2, time: time.Now()}}}},
+		{name: "unknown mount path only matches exactly", kvPath: "kv/other",
+			cached: map[string]map[string]mount{server: {"kv/app": {version: 1, time: time.Now()}}}},
+		{name: "expired mount", kvPath: "secret/app",
+			cached: map[string]map[string]mount{server: {"secret/app": {path: "secret/", version: 2, time: expired}}}},
+		{name: "other server", kvPath: "secret/app",
+			cached: map[string]map[string]mount{"https://other:8200|": {"secret/app": {path: "secret/", version: 2, time: time.Now()}}}},
+		{name: "other namespace", kvPath: "secret/app",
+			cached: map[string]map[string]mount{server + "team-a": {"secret/app": {path: "secret/", version: 2, time: time.Now()}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mountsMutex.Lock()
+			mounts = tt.cached
+			m, found := lookupMount(server, tt.kvPath)
+			mountsMutex.Unlock()
+			defer resetMounts()
+
+			if found != tt.wantFound || m.version != tt.wantVersion {
+				t.Errorf("lookupMount()=%+v %t, want version %d %t", m, found, tt.wantVersion, tt.wantFound)
+			}
+		})
+	}
+}
+
+func TestMountKvVersion(t *testing.T) {
+	defer resetMounts()
+	stub := newVaultStub(t, map[string]http.HandlerFunc{
+		"GET /v1/sys/internal/ui/mounts/secret/app": respond(http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{"path": "secret/", "options": map[string]interface{}{"version": "2"}},
+		}),
+		"GET /v1/sys/internal/ui/mounts/legacy/app": respond(http.StatusNotFound, map[string]interface{}{"errors": []string{}}),
+	})
+	defer stub.Close()
+
+	vclient, err := stub.config().newClient()
+	if err != nil {
+		t.Fatalf("newClient() err=%v", err)
+	}
+	detections := func() int {
+		count := 0
+		for _, r := range stub.requests {
+			if strings.HasPrefix(r.route, "GET /v1/sys/internal/ui/mounts/") {
+				count++
+			}
+		}
+		return count
+	}
+
+	tests := []struct {
+		name           string
+		kvPath         string
+		invalidate     bool
+		wantVersion    int
+		wantDetections int
+	}{
+		{name: "detected", kvPath: "/secret/app/", wantVersion: 2, wantDetections: 1},
+		{name: "cached", kvPath: "secret/app", wantVersion: 2, wantDetections: 1},
+		{name: "cached from another path of the mount", kvPath: "secret/other", wantVersion: 2, wantDetections: 1},
+		{name: "detected again once invalidated", kvPath: "secret/app", invalidate: true, wantVersion: 2, wantDetections: 2},
+		{name: "version 1 if detection is not supported", kvPath: "legacy/app", wantVersion: 1, wantDetections: 3},
+		{name: "version 1 cached", kvPath: "legacy/app", wantVersion: 1, wantDetections: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.invalidate {
+				invalidateMountKvVersion(vclient, tt.kvPath)
+			}
+			version, err := mountKvVersion(vclient, tt.kvPath)
+			if err != nil {
+				t.Fatalf("mountKvVersion() err=%v", err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("mountKvVersion()=%d, want %d", version, tt.wantVersion)
+			}
+			stub.mutex.Lock()
+			got := detections()
+			stub.mutex.Unlock()
+			if got != tt.wantDetections {
+				t.Errorf("detections=%d, want %d", got, tt.wantDetections)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+const (
+	// KeyAlgorithmRSA generates RSA private keys
+	KeyAlgorithmRSA = "rsa"
+	// KeyAlgorithmECDSA generates ECDSA private keys
+	KeyAlgorithmECDSA = "ecdsa"
+	// KeyAlgorithmEd25519 generates Ed25519 private keys
+	KeyAlgorithmEd25519 = "ed25519"
+
+	// DefaultRSAKeySize is the default size of RSA keys, in bits
+	DefaultRSAKeySize = 2048
+	// DefaultECDSAKeySize is the default size of ECDSA keys, in bits (P-256 curve)
+	DefaultECDSAKeySize = 256
+)
+
+// CertificateRequest is a request of a certificate to a PKI secrets engine
+type CertificateRequest struct {
+	CommonName string
+	// AltNames are DNS names or email addresses
+	AltNames []string
+	IPSANs   []string
+	URISANs  []string
+	// TTL is the requested lifetime of the certificate, the role's TTL is used if 0
+	TTL time.Duration
+}
+
+// Certificate is a certificate issued by a PKI secrets engine, PEM encoded
+type Certificate struct {
+	Certificate string
+	// PrivateKey is empty if the certificate has been signed from a CSR
+	PrivateKey   string
+	IssuingCA    string
+	CAChain      []string
+	SerialNumber string
+}
+
+// IssueCertificate issues a certificate and its private key from a PKI secrets engine's role
+func IssueCertificate(client *vapi.Client, mount, role string, req CertificateRequest) (*Certificate, error) {
+	issuePath := path.Join(mount, "issue", role)
+	secret, err := client.Logical().Write(issuePath, req.data())
+	if err != nil {
+		return nil, err
+	}
+
+	return certificateFromSecret(issuePath, secret)
+}
+
+// SignCertificate signs a certificate request (PEM encoded CSR) using a PKI secrets engine's role
+// The private key never leaves the caller
+func SignCertificate(client *vapi.Client, mount, role string, req CertificateRequest, csr []byte) (*Certificate, error) {
+	signPath := path.Join(mount, "sign", role)
+	data := req.data()
+	data["csr"] = string(csr)
+	secret, err := client.Logical().Write(signPath, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return certificateFromSecret(signPath, secret)
+}
+
+// GeneratePrivateKey generates a private key, the default size of the algorithm is used if size is 0
+// The key is returned along with its PEM encoding
+func GeneratePrivateKey(algorithm string, size int) (crypto.Signer, []byte, error) {
+	var key crypto.Signer
+	var err error
+
+	switch algorithm {
+	case KeyAlgorithmRSA, "":
+		if size == 0 {
+			size = DefaultRSAKeySize
+		}
+		if size != 2048 && size != 3072 && size != 4096 {
+			return nil, nil, fmt.Errorf("Unsupported RSA key size %d, must be 2048, 3072 or 4096", size)
+		}
+		key, err = rsa.GenerateKey(rand.Reader, size)
+	case KeyAlgorithmECDSA:
+		if size == 0 {
+			size = DefaultECDSAKeySize
+		}
+		var curve elliptic.Curve
+		switch size {
+		case 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, nil, fmt.Errorf("Unsupported ECDSA key size %d, must be 256, 384 or 521", size)
+		}
+		key, err = ecdsa.GenerateKey(curve, rand.Reader)
+	case KeyAlgorithmEd25519:
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, nil, fmt.Errorf("Unsupported key algorithm %s", algorithm)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// ParsePrivateKey parses a PEM encoded private key (PKCS#1, SEC 1 or PKCS#8)
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM encoded private key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse private key, err=%v", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type %T", key)
+	}
+
+	return signer, nil
+}
+
+// PrivateKeyMatches checks whether a private key has the given algorithm and size (default size if 0)
+func PrivateKeyMatches(key crypto.Signer, algorithm string, size int) bool {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if size == 0 {
+			size = DefaultRSAKeySize
+		}
+		return (algorithm == KeyAlgorithmRSA || algorithm == "") && k.N.BitLen() == size
+	case *ecdsa.PrivateKey:
+		if size == 0 {
+			size = DefaultECDSAKeySize
+		}
+		return algorithm == KeyAlgorithmECDSA && k.Curve.Params().BitSize == size
+	case ed25519.PrivateKey:
+		return algorithm == KeyAlgorithmEd25519
+	}
+	return false
+}
+
+// CreateCertificateRequest creates a PEM encoded CSR for the request, signed by the private key
+func CreateCertificateRequest(key crypto.Signer, req CertificateRequest) ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: req.CommonName},
+	}
+	for _, name := range req.AltNames {
+		if strings.Contains(name, "@") {
+			template.EmailAddresses = append(template.EmailAddresses, name)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	for _, ip := range req.IPSANs {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return nil, fmt.Errorf("Invalid IP address %s", ip)
+		}
+		template.IPAddresses = append(template.IPAddresses, parsed)
+	}
+	for _, uri := range req.URISANs {
+		parsed, err := url.Parse(uri)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid URI %s, err=%v", uri, err)
+		}
+		template.URIs = append(template.URIs, parsed)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// Chain returns the certificate followed by the CA chain
+func (c *Certificate) Chain() string {
+	chain := []string{c.Certificate}
+	if len(c.CAChain) > 0 {
+		chain = append(chain, c.CAChain...)
+	} else if c.IssuingCA != "" {
+		chain = append(chain, c.IssuingCA)
+	}
+	return strings.Join(chain, "\n")
+}
+
+// data returns the parameters of the request sent to vault
+func (req CertificateRequest) data() map[string]interface{} {
+	data := map[string]interface{}{
+		"common_name": req.CommonName,
+		"format":      "pem",
+	}
+	if len(req.AltNames) > 0 {
+		data["alt_names"] = strings.Join(req.AltNames, ",")
+	}
+	if len(req.IPSANs) > 0 {
+		data["ip_sans"] = strings.Join(req.IPSANs, ",")
+	}
+	if len(req.URISANs) > 0 {
+		data["uri_sans"] = strings.Join(req.URISANs, ",")
+	}
+	if req.TTL > 0 {
+		data["ttl"] = fmt.Sprintf("%ds", int64(req.TTL.Seconds()))
+	}
+	return data
+}
+
+// certificateFromSecret reads a certificate returned by vault
+func certificateFromSecret(path string, secret *vapi.Secret) (*Certificate, error) {
+	if secret == nil || secret.Data == nil {
+		return nil, &PathNotFound{path}
+	}
+
+	c := &Certificate{}
+	c.Certificate, _ = secret.Data["certificate"].(string)
+	c.PrivateKey, _ = secret.Data["private_key"].(string)
+	c.IssuingCA, _ = secret.Data["issuing_ca"].(string)
+	c.SerialNumber, _ = secret.Data["serial_number"].(string)
+	if chain, ok := secret.Data["ca_chain"].([]interface{}); ok {
+		for _, ca := range chain {
+			if pem, ok := ca.(string); ok {
+				c.CAChain = append(c.CAChain, pem)
+			}
+		}
+	}
+
+	if c.Certificate == "" {
+		return nil, fmt.Errorf("No certificate returned by vault for %s", path)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,320 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	routeIssue = "PUT /v1/pki/issue/web"
+	routeSign  = "PUT /v1/pki/sign/web"
+)
+
+func TestCertificateRequestData(t *testing.T) {
+	tests := []struct {
+		name string
+		req  CertificateRequest
+		want map[string]interface{}
+	}{
+		{name: "common name only", req: CertificateRequest{CommonName: "app.example.com"},
+			want: map[string]interface{}{"common_name": "app.example.com", "format": "pem"}},
+		{name: "subject alternative names", req: CertificateRequest{
+			CommonName: "app.example.com",
+			AltNames:   []string{"app", "admin@example.com"},
+			IPSANs:     []string{"10.0.0.1", "::1"},
+			URISANs:    []string{"spiffe://example.com/app"},
+		}, want: map[string]interface{}{
+			"common_name": "app.example.com", "format": "pem",
+			"alt_names": "app,admin@example.com", "ip_sans": "10.0.0.1,::1", "uri_sans": "spiffe://example.com/app",
+		}},
+		{name: "ttl in seconds", req: CertificateRequest{CommonName: "app.example.com", TTL: 90 * time.Minute},
+			want: map[string]interface{}{"common_name": "app.example.com", "format": "pem", "ttl": "5400s"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.data(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("data()=%v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIssueCertificate(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		response  map[string]interface{}
+		wantErr   bool
+		wantChain string
+	}{
+		{name: "CA chain", status: http.StatusOK, response: map[string]interface{}{
+			"certificate": "CERT", "private_key": "KEY", "issuing_ca": "INTERMEDIATE",
+			"ca_chain": []string{"INTERMEDIATE", "ROOT"}, "serial_number": "01:02",
+		}, wantChain: "CERT\nINTERMEDIATE\nROOT"},
+		{name: "issuing CA only", status: http.StatusOK, response: map[string]interface{}{
+			"certificate": "CERT", "private_key": "KEY", "issuing_ca": "ROOT", "serial_number": "01:02",
+		}, wantChain: "CERT\nROOT"},
+		{name: "no certificate returned", status: http.StatusOK, response: map[string]interface{}{"private_key": "KEY"}, wantErr: true},
+		{name: "permission denied", status: http.StatusForbidden, response: map[string]interface{}{"errors": []string{"permission denied"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newVaultStub(t, map[string]http.HandlerFunc{
+				routeIssue: respond(tt.status, map[string]interface{}{"data": tt.response}),
+			})
+			defer stub.Close()
+			vclient, err := stub.config().newClient()
+			if err != nil {
+				t.Fatalf("newClient() err=%v", err)
+			}
+
+			cert, err := IssueCertificate(vclient, "pki", "web", CertificateRequest{CommonName: "app.example.com"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("IssueCertificate() err=%v, wantErr %t", err, tt.wantErr)
+			}
+			if got := stub.received(routeIssue); len(got) != 1 || got[0].body["common_name"] != "app.example.com" {
+				t.Errorf("requests=%+v, want 1 request for app.example.com", got)
+			}
+			if tt.wantErr {
+				return
+			}
+			if cert.PrivateKey != "KEY" || cert.SerialNumber != "01:02" {
+				t.Errorf("IssueCertificate()=%+v, want private key and serial number", cert)
+			}
+			if got := cert.Chain(); got != tt.wantChain {
+				t.Errorf("Chain()=%q, want %q", got, tt.wantChain)
+			}
+		})
+	}
+}
+
+func TestGeneratePrivateKey(t *testing.T) {
+	tests := []struct {
+		name      string
+		algorithm string
+		size      int
+		wantErr   bool
+		wantSize  int
+	}{
+		{name: "default algorithm", algorithm: "", wantSize: DefaultRSAKeySize},
+		{name: "rsa default size", algorithm: KeyAlgorithmRSA, wantSize: DefaultRSAKeySize},
+		{name: "rsa 3072", algorithm: KeyAlgorithmRSA, size: 3072, wantSize: 3072},
+		{name: "rsa 1024 rejected", algorithm: KeyAlgorithmRSA, size: 1024, wantErr: true},
+		{name: "rsa 2560 rejected", algorithm: KeyAlgorithmRSA, size: 2560, wantErr: true},
+		{name: "ecdsa default size", algorithm: KeyAlgorithmECDSA, wantSize: DefaultECDSAKeySize},
+		{name: "ecdsa 384", algorithm: KeyAlgorithmECDSA, size: 384, wantSize: 384},
+		{name: "ecdsa 521", algorithm: KeyAlgorithmECDSA, size: 521, wantSize: 521},
+		{name: "ecdsa 224 rejected", algorithm: KeyAlgorithmECDSA, size: 224, wantErr: true},
+		{name: "ed25519", algorithm: KeyAlgorithmEd25519},
+		{name: "ed25519 size ignored", algorithm: KeyAlgorithmEd25519, size: 4096},
+		{name: "unknown algorithm", algorithm: "dsa", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, keyPEM, err := GeneratePrivateKey(tt.algorithm, tt.size)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GeneratePrivateKey() err=%v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			switch k := key.(type) {
+			case *rsa.PrivateKey:
+				if k.N.BitLen() != tt.wantSize {
+					t.Errorf("RSA key size=%d, want %d", k.N.BitLen(), tt.wantSize)
+				}
+			case *ecdsa.PrivateKey:
+				if k.Curve.Params().BitSize != tt.wantSize {
+					t.Errorf("ECDSA key size=%d, want %d", k.Curve.Params().BitSize, tt.wantSize)
+				}
+			case ed25519.PrivateKey:
+				if tt.algorithm != KeyAlgorithmEd25519 {
+					t.Errorf("Ed25519 key generated for %s", tt.algorithm)
+				}
+			}
+			if !PrivateKeyMatches(key, tt.algorithm, tt.size) {
+				t.Errorf("PrivateKeyMatches()=false for the generated key")
+			}
+
+			// The PEM encoding is the same key
+			parsed, err := ParsePrivateKey(keyPEM)
+			if err != nil {
+				t.Fatalf("ParsePrivateKey() err=%v", err)
+			}
+			if !reflect.DeepEqual(parsed.Public(), key.Public()) {
+				t.Errorf("ParsePrivateKey() returned another key")
+			}
+		})
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	rsaKey, _, _ := GeneratePrivateKey(KeyAlgorithmRSA, 0)
+	ecKey, _, _ := GeneratePrivateKey(KeyAlgorithmECDSA, 0)
+	ecDER, _ := x509.MarshalECPrivateKey(ecKey.(*ecdsa.PrivateKey))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{name: "PKCS#1", data: pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey.(*rsa.PrivateKey))})},
+		{name: "SEC 1", data: pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER})},
+		{name: "not PEM encoded", data: []byte("private key"), wantErr: true},
+		{name: "invalid key", data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("invalid")}), wantErr: true},
+		{name: "empty", data: nil, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParsePrivateKey(tt.data); (err != nil) != tt.wantErr {
+				t.Errorf("ParsePrivateKey() err=%v, wantErr %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPrivateKeyMatches(t *testing.T) {
+	rsaKey, _, _ := GeneratePrivateKey(KeyAlgorithmRSA, 2048)
+	ecKey, _, _ := GeneratePrivateKey(KeyAlgorithmECDSA, 384)
+	edKey, _, _ := GeneratePrivateKey(KeyAlgorithmEd25519, 0)
+
+	tests := []struct {
+		name      string
+		key       crypto.Signer
+		algorithm string
+		size      int
+		want      bool
+	}{
+		{name: "rsa default", key: rsaKey, algorithm: "", want: true},
+		{name: "rsa same size", key: rsaKey, algorithm: KeyAlgorithmRSA, size: 2048, want: true},
+		{name: "rsa other size", key: rsaKey, algorithm: KeyAlgorithmRSA, size: 4096, want: false},
+		{name: "rsa other algorithm", key: rsaKey, algorithm: KeyAlgorithmECDSA, want: false},
+		{name: "ecdsa same size", key: ecKey, algorithm: KeyAlgorithmECDSA, size: 384, want: true},
+		{name: "ecdsa default size", key: ecKey, algorithm: KeyAlgorithmECDSA, want: false},
+		{name: "ecdsa other algorithm", key: ecKey, algorithm: KeyAlgorithmRSA, size: 384, want: false},
+		{name: "ed25519", key: edKey, algorithm: KeyAlgorithmEd25519, want: true},
+		{name: "ed25519 other algorithm", key: edKey, algorithm: "", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PrivateKeyMatches(tt.key, tt.algorithm, tt.size); got != tt.want {
+				t.Errorf("PrivateKeyMatches()=%t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateCertificateRequest(t *testing.T) {
+	key, _, _ := GeneratePrivateKey(KeyAlgorithmECDSA, 0)
+
+	tests := []struct {
+		name       string
+		req        CertificateRequest
+		wantErr    bool
+		wantDNS    []string
+		wantEmails []string
+		wantIPs    int
+		wantURIs   int
+	}{
+		{name: "common name only", req: CertificateRequest{CommonName: "app.example.com"}},
+		{name: "subject alternative names", req: CertificateRequest{
+			CommonName: "app.example.com",
+			AltNames:   []string{"app", "admin@example.com"},
+			IPSANs:     []string{"10.0.0.1", "::1"},
+			URISANs:    []string{"spiffe://example.com/app"},
+		}, wantDNS: []string{"app"}, wantEmails: []string{"admin@example.com"}, wantIPs: 2, wantURIs: 1},
+		{name: "invalid IP address", req: CertificateRequest{CommonName: "app.example.com", IPSANs: []string{"10.0.0"}}, wantErr: true},
+		{name: "invalid URI", req: CertificateRequest{CommonName: "app.example.com", URISANs: []string{"spiffe://%zz"}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			csrPEM, err := CreateCertificateRequest(key, tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CreateCertificateRequest() err=%v, wantErr %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			block, _ := pem.Decode(csrPEM)
+			if block == nil || block.Type != "CERTIFICATE REQUEST" {
+				t.Fatalf("CreateCertificateRequest()=%s, want a PEM encoded CSR", csrPEM)
+			}
+			csr, err := x509.ParseCertificateRequest(block.Bytes)
+			if err != nil {
+				t.Fatalf("ParseCertificateRequest() err=%v", err)
+			}
+			if err := csr.CheckSignature(); err != nil {
+				t.Errorf("CheckSignature() err=%v", err)
+			}
+			if !reflect.DeepEqual(csr.PublicKey, key.Public()) {
+				t.Errorf("CSR public key is not the one of the private key")
+			}
+			if csr.Subject.CommonName != tt.req.CommonName || !reflect.DeepEqual(csr.DNSNames, tt.wantDNS) ||
+				!reflect.DeepEqual(csr.EmailAddresses, tt.wantEmails) || len(csr.IPAddresses) != tt.wantIPs || len(csr.URIs) != tt.wantURIs {
+				t.Errorf("CSR CN=%s DNS=%v emails=%v IPs=%v URIs=%v", csr.Subject.CommonName, csr.DNSNames, csr.EmailAddresses, csr.IPAddresses, csr.URIs)
+			}
+		})
+	}
+}
+
+func TestSignCertificate(t *testing.T) {
+	stub := newVaultStub(t, map[string]http.HandlerFunc{
+		routeSign: respond(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{
+			"certificate": "CERT", "issuing_ca": "ROOT", "serial_number": "01:02",
+		}}),
+	})
+	defer stub.Close()
+	vclient, err := stub.config().newClient()
+	if err != nil {
+		t.Fatalf("newClient() err=%v", err)
+	}
+
+	cert, err := SignCertificate(vclient, "pki", "web", CertificateRequest{CommonName: "app.example.com", TTL: time.Hour}, []byte("CSR"))
+	if err != nil {
+		t.Fatalf("SignCertificate() err=%v", err)
+	}
+	if cert.PrivateKey != "" || cert.Chain() != "CERT\nROOT" {
+		t.Errorf("SignCertificate()=%+v, want the certificate without private key", cert)
+	}
+
+	requests := stub.received(routeSign)
+	if len(requests) != 1 {
+		t.Fatalf("requests=%d, want 1", len(requests))
+	}
+	want := map[string]interface{}{"common_name": "app.example.com", "format": "pem", "ttl": "3600s", "csr": "CSR"}
+	if !reflect.DeepEqual(requests[0].body, want) {
+		t.Errorf("request=%v, want %v", requests[0].body, want)
+	}
+}
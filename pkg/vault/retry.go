@@ -0,0 +1,161 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// retryTransport retries the requests to vault failing with a transient error using an exponential backoff
+// with jitter, and limits the rate of the requests.
+// Requests are retried on 429 whatever their method. Connection errors and 5xx are only retried for
+// idempotent requests (GET, HEAD and LIST) as others (e.g. logins or dynamic credentials) may have been processed.
+type retryTransport struct {
+	next       http.RoundTripper
+	maxRetries int
+	// minWait and maxWait bound the time to wait between two attempts
+	minWait, maxWait time.Duration
+	// maxDuration caps the total time spent on a request, no more attempt is done past it, no cap if 0
+	maxDuration time.Duration
+	// failover is true if other vault servers can be used, connection errors and 5xx are then left to the failover
+	failover bool
+	// limiter limits the rate of the requests to a vault server, shared by all clients, nil if no limit
+	limiter *rate.Limiter
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqLogger := log.WithValues("func", "retryTransport.RoundTrip")
+	ctx := req.Context()
+	start := time.Now()
+
+	// Body is kept to be sent again on retries
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for attempt := 0; ; attempt++ {
+		if t.limiter != nil {
+			if err := t.limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.next.RoundTrip(cloneRequest(req, body))
+		if attempt >= t.maxRetries || !t.retryable(req, resp, err) || ctx.Err() != nil {
+			return resp, err
+		}
+
+		wait := t.backoff(attempt, resp)
+		if t.maxDuration > 0 && time.Since(start)+wait > t.maxDuration {
+			return resp, err
+		}
+		if err != nil {
+			reqLogger.Info("Vault request failed, retrying", "path", req.URL.Path, "wait", wait.String(), "err", err.Error())
+		} else {
+			reqLogger.Info("Vault request failed, retrying", "path", req.URL.Path, "wait", wait.String(), "status", resp.StatusCode)
+			// Draining the body to reuse the connection
+			io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// backoff returns the time to wait before the next attempt
+// The Retry-After header sent along with a 429 response is honored, up to maxWait
+func (t *retryTransport) backoff(attempt int, resp *http.Response) time.Duration {
+	wait := t.maxWait
+	if attempt < 32 && t.minWait<<uint(attempt) < t.maxWait && t.minWait<<uint(attempt) > 0 {
+		wait = t.minWait << uint(attempt)
+	}
+	// Equal jitter, waiting between half and the whole backoff
+	if wait >= 2 {
+		wait = wait/2 + time.Duration(rand.Int63n(int64(wait/2)))
+	}
+
+	if resp != nil && resp.StatusCode == http.StatusTooManyRequests {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			retryAfter := time.Duration(seconds) * time.Second
+			if retryAfter > t.maxWait {
+				retryAfter = t.maxWait
+			}
+			if retryAfter > wait {
+				wait = retryAfter
+			}
+		}
+	}
+
+	return wait
+}
+
+// readBody reads and closes the body of a request to be able to send it several times
+func readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+
+	defer req.Body.Close()
+	return ioutil.ReadAll(req.Body)
+}
+
+// cloneRequest clones a request, setting its body
+func cloneRequest(req *http.Request, body []byte) *http.Request {
+	r := req.Clone(req.Context())
+	if body != nil {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	return r
+}
+
+// retryable checks whether a request can be sent again
+func (t *retryTransport) retryable(req *http.Request, resp *http.Response, err error) bool {
+	if err == nil && resp.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	if t.failover || !idempotent(req) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+
+	return resp.StatusCode >= http.StatusInternalServerError && resp.StatusCode != http.StatusNotImplemented
+}
+
+// idempotent checks whether a request can be processed several times by vault without side effects
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, "LIST":
+		return true
+	}
+	return false
+}
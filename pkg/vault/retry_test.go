@@ -0,0 +1,190 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryTransportRetryable(t *testing.T) {
+	connErr := errors.New("connection refused")
+
+	tests := []struct {
+		name     string
+		method   string
+		status   int
+		err      error
+		failover bool
+		want     bool
+	}{
+		{name: "GET connection error", method: http.MethodGet, err: connErr, want: true},
+		{name: "HEAD 500", method: http.MethodHead, status: http.StatusInternalServerError, want: true},
+		{name: "LIST 503", method: "LIST", status: http.StatusServiceUnavailable, want: true},
+		{name: "GET 501", method: http.MethodGet, status: http.StatusNotImplemented, want: false},
+		{name: "GET 404", method: http.MethodGet, status: http.StatusNotFound, want: false},
+		{name: "GET 200", method: http.MethodGet, status: http.StatusOK, want: false},
+		{name: "PUT connection error", method: http.MethodPut, err: connErr, want: false},
+		{name: "POST 503", method: http.MethodPost, status: http.StatusServiceUnavailable, want: false},
+		{name: "PUT 429", method: http.MethodPut, status: http.StatusTooManyRequests, want: true},
+		{name: "GET 429", method: http.MethodGet, status: http.StatusTooManyRequests, want: true},
+		{name: "GET connection error with failover", method: http.MethodGet, err: connErr, failover: true, want: false},
+		{name: "GET 503 with failover", method: http.MethodGet, status: http.StatusServiceUnavailable, failover: true, want: false},
+		{name: "PUT 429 with failover", method: http.MethodPut, status: http.StatusTooManyRequests, failover: true, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &retryTransport{failover: tt.failover}
+			req := httptest.NewRequest(tt.method, "http://vault:8200/v1/secret/foo", nil)
+			var resp *http.Response
+			if tt.err == nil {
+				resp = &http.Response{StatusCode: tt.status}
+			}
+
+			if got := transport.retryable(req, resp, tt.err); got != tt.want {
+				t.Errorf("retryable()=%t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryTransportBackoff(t *testing.T) {
+	transport := &retryTransport{minWait: 100 * time.Millisecond, maxWait: time.Second}
+
+	tests := []struct {
+		name       string
+		attempt    int
+		retryAfter string
+		min, max   time.Duration
+	}{
+		{name: "first attempt", attempt: 0, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{name: "doubled on each attempt", attempt: 2, min: 200 * time.Millisecond, max: 400 * time.Millisecond},
+		{name: "capped to maxWait", attempt: 10, min: 500 * time.Millisecond, max: time.Second},
+		{name: "overflow capped to maxWait", attempt: 100, min: 500 * time.Millisecond, max: time.Second},
+		{name: "Retry-After honored", attempt: 0, retryAfter: "1", min: time.Second, max: time.Second},
+		{name: "Retry-After capped to maxWait", attempt: 0, retryAfter: "60", min: time.Second, max: time.Second},
+		{name: "invalid Retry-After ignored", attempt: 0, retryAfter: "soon", min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp *http.Response
+			if tt.retryAfter != "" {
+				resp = &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {tt.retryAfter}}}
+			}
+
+			for i := 0; i < 20; i++ {
+				if got := transport.backoff(tt.attempt, resp); got < tt.min || got > tt.max {
+					t.Fatalf("backoff()=%s, want between %s and %s", got, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryTransportRoundTrip(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		statuses     []int
+		maxRetries   int
+		wantAttempts int
+		wantStatus   int
+	}{
+		{name: "read retried until success", method: http.MethodGet,
+			statuses: []int{503, 500, 200}, maxRetries: 3, wantAttempts: 3, wantStatus: 200},
+		{name: "read retried up to maxRetries", method: http.MethodGet,
+			statuses: []int{503, 503, 503, 503}, maxRetries: 2, wantAttempts: 3, wantStatus: 503},
+		{name: "write not retried on 5xx", method: http.MethodPut,
+			statuses: []int{503, 200}, maxRetries: 3, wantAttempts: 1, wantStatus: 503},
+		{name: "write retried on 429", method: http.MethodPut,
+			statuses: []int{429, 200}, maxRetries: 3, wantAttempts: 2, wantStatus: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int64
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				attempt := atomic.AddInt64(&attempts, 1)
+				// The body is sent again on each attempt
+				if req.Method == http.MethodPut {
+					body := make([]byte, 64)
+					n, _ := req.Body.Read(body)
+					if string(body[:n]) != "payload" {
+						t.Errorf("attempt %d: body=%q, want payload", attempt, body[:n])
+					}
+				}
+				w.WriteHeader(tt.statuses[attempt-1])
+			}))
+			defer server.Close()
+
+			transport := &retryTransport{
+				next:       http.DefaultTransport,
+				maxRetries: tt.maxRetries,
+				minWait:    time.Millisecond,
+				maxWait:    10 * time.Millisecond,
+			}
+			req, _ := http.NewRequest(tt.method, server.URL, strings.NewReader("payload"))
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() err=%v", err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status=%d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if got := atomic.LoadInt64(&attempts); got != int64(tt.wantAttempts) {
+				t.Errorf("attempts=%d, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryTransportMaxDuration(t *testing.T) {
+	var attempts int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&attempts, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	transport := &retryTransport{
+		next:        http.DefaultTransport,
+		maxRetries:  10,
+		minWait:     100 * time.Millisecond,
+		maxWait:     100 * time.Millisecond,
+		maxDuration: 120 * time.Millisecond,
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() err=%v", err)
+	}
+	resp.Body.Close()
+
+	// Waits are between 50ms and 100ms, no attempt is done past 120ms
+	if got := atomic.LoadInt64(&attempts); got < 2 || got > 3 {
+		t.Errorf("attempts=%d, want 2 or 3", got)
+	}
+}
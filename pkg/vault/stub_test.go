@@ -0,0 +1,104 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// vaultStub is a fake vault server answering the requests with the handlers registered
+// by method and path (e.g. "GET /v1/auth/token/lookup-self") and recording them
+type vaultStub struct {
+	*httptest.Server
+	t        *testing.T
+	mutex    sync.Mutex
+	handlers map[string]http.HandlerFunc
+	requests []stubRequest
+}
+
+// stubRequest is a request received by a vaultStub
+type stubRequest struct {
+	route string
+	token string
+	body  map[string]interface{}
+}
+
+// newVaultStub starts a vaultStub, it has to be closed
+func newVaultStub(t *testing.T, handlers map[string]http.HandlerFunc) *vaultStub {
+	s := &vaultStub{t: t, handlers: handlers}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// serveHTTP records a request and calls the handler of its route, 404 if none
+func (s *vaultStub) serveHTTP(w http.ResponseWriter, req *http.Request) {
+	route := req.Method + " " + req.URL.Path
+	var body map[string]interface{}
+	json.NewDecoder(req.Body).Decode(&body)
+
+	s.mutex.Lock()
+	s.requests = append(s.requests, stubRequest{route: route, token: req.Header.Get("X-Vault-Token"), body: body})
+	handler, found := s.handlers[route]
+	s.mutex.Unlock()
+
+	if !found {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{"errors": []string{"no handler for " + route}})
+		return
+	}
+	handler(w, req)
+}
+
+// received returns the requests received for a route
+func (s *vaultStub) received(route string) []stubRequest {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var requests []stubRequest
+	for _, r := range s.requests {
+		if r.route == route {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// config returns the configuration of a connection to the stub, requests are not retried
+func (s *vaultStub) config() *Config {
+	c := NewConfig(s.URL)
+	transportConfig := DefaultTransportConfig()
+	transportConfig.MaxRetries = 0
+	c.ClientFactory = NewClientFactory(transportConfig)
+	return c
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// respond returns a handler writing a JSON response
+func respond(status int, v interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		writeJSON(w, status, v)
+	}
+}
@@ -17,9 +17,6 @@ limitations under the License.
 package vault
 
 import (
-	"crypto/tls"
-	"net/http"
-
 	vapi "github.com/hashicorp/vault/api"
 )
 
@@ -37,25 +34,19 @@ func NewTokenProvider(token string) *TokenProvider {
 	}
 }
 
+// Identity - godoc
+func (t TokenProvider) Identity() string {
+	return "token:" + t.Token
+}
+
 // Login - godoc
 func (t TokenProvider) Login(c *Config) (*vapi.Client, error) {
 	log.Info("Authenticating using Token auth method")
-	config := vapi.DefaultConfig()
-	config.Address = c.Address
-	config.HttpClient.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: c.Insecure},
-	}
-
-	vclient, err := vapi.NewClient(config)
+	vclient, err := c.newClient()
 	if err != nil {
 		return nil, err
 	}
 
-	vaultNamespace := c.Namespace
-	if vaultNamespace != "" {
-		vclient.SetNamespace(vaultNamespace)
-	}
-
 	vclient.SetToken(t.Token)
 	return vclient, nil
 }
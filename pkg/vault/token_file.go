@@ -0,0 +1,214 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	vapi "github.com/hashicorp/vault/api"
+)
+
+var _ AuthProvider = (*TokenFileProvider)(nil)
+
+var (
+	// tokenFiles keeps track of the watched token files and of the clients using them
+	tokenFiles      = make(map[string]*tokenFile)
+	tokenFilesMutex sync.Mutex
+	// tokenFilesWatcher is the watcher shared by all the token files, created on first use
+	tokenFilesWatcher *fsnotify.Watcher
+)
+
+// tokenFile is a token file and the clients to update when its content changes
+type tokenFile struct {
+	token string
+	// clients are indexed like the tokens of the TokenManager (see tokenKey) so that a new login replaces the previous client
+	clients map[string]*vapi.Client
+}
+
+// TokenFileProvider connects to vault using a token read from a file (e.g. a Vault Agent sink)
+// The file is watched and the token of the clients is swapped in place when it changes
+type TokenFileProvider struct {
+	Path string
+}
+
+// NewTokenFileProvider creates a pointer to a TokenFileProvider
+func NewTokenFileProvider(path string) *TokenFileProvider {
+	return &TokenFileProvider{
+		Path: filepath.Clean(path),
+	}
+}
+
+// Identity returns the path of the file the token is read from
+func (t TokenFileProvider) Identity() string {
+	return "tokenfile:" + t.Path
+}
+
+// Login - godoc
+func (t TokenFileProvider) Login(c *Config) (*vapi.Client, error) {
+	log.Info("Authenticating using a token file", "path", t.Path)
+	vclient, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := readTokenFile(t.Path)
+	if err != nil {
+		return nil, err
+	}
+	vclient.SetToken(token)
+
+	if err := watchTokenFile(t.Path, tokenKey(c, t), vclient); err != nil {
+		return nil, err
+	}
+
+	return vclient, nil
+}
+
+// readTokenFile reads a token from a file
+func readTokenFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Unable to read token file %s, err=%v", path, err)
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("Token file %s is empty", path)
+	}
+
+	return token, nil
+}
+
+// watchTokenFile registers a client to update when the token file changes
+// The directory of the file is watched as files are usually replaced by a rename (e.g. Vault Agent sinks, projected volumes)
+func watchTokenFile(path, key string, vclient *vapi.Client) error {
+	tokenFilesMutex.Lock()
+	defer tokenFilesMutex.Unlock()
+
+	if tokenFilesWatcher == nil {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return fmt.Errorf("Unable to create token file watcher, err=%v", err)
+		}
+		tokenFilesWatcher = watcher
+		go processTokenFilesEvents(watcher)
+	}
+
+	f, found := tokenFiles[path]
+	if !found {
+		if err := tokenFilesWatcher.Add(filepath.Dir(path)); err != nil {
+			return fmt.Errorf("Unable to watch token file %s, err=%v", path, err)
+		}
+		f = &tokenFile{clients: make(map[string]*vapi.Client)}
+		tokenFiles[path] = f
+	}
+
+	f.token = vclient.Token()
+	f.clients[key] = vclient
+
+	return nil
+}
+
+// unwatchTokenFile unregisters a client not used anymore (e.g. its token has been released)
+// Token files without any client left are not watched anymore
+func unwatchTokenFile(vclient *vapi.Client) {
+	tokenFilesMutex.Lock()
+	defer tokenFilesMutex.Unlock()
+
+	for path, f := range tokenFiles {
+		for key, c := range f.clients {
+			if c == vclient {
+				delete(f.clients, key)
+			}
+		}
+		if len(f.clients) > 0 {
+			continue
+		}
+
+		delete(tokenFiles, path)
+		if !watchedDir(filepath.Dir(path)) {
+			if err := tokenFilesWatcher.Remove(filepath.Dir(path)); err != nil {
+				log.V(1).Info("Unable to stop watching token file", "path", path, "err", err)
+			}
+		}
+	}
+}
+
+// watchedDir checks whether a token file located in dir is still watched, tokenFilesMutex must be held
+func watchedDir(dir string) bool {
+	for path := range tokenFiles {
+		if filepath.Dir(path) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// processTokenFilesEvents reloads the token files when their directory changes
+func processTokenFilesEvents(watcher *fsnotify.Watcher) {
+	reqLogger := log.WithValues("func", "processTokenFilesEvents")
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			reloadTokenFiles(filepath.Dir(event.Name))
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			reqLogger.Error(err, "Error watching token files")
+		}
+	}
+}
+
+// reloadTokenFiles reads again the token files located in dir and swaps the token of their clients if it changed
+func reloadTokenFiles(dir string) {
+	reqLogger := log.WithValues("func", "reloadTokenFiles")
+
+	tokenFilesMutex.Lock()
+	defer tokenFilesMutex.Unlock()
+
+	for path, f := range tokenFiles {
+		if filepath.Dir(path) != dir {
+			continue
+		}
+
+		token, err := readTokenFile(path)
+		if err != nil {
+			// The file may be in the middle of being replaced, keeping the current token
+			reqLogger.V(1).Info("Unable to reload token file", "path", path, "err", err)
+			continue
+		}
+		if token == f.token {
+			continue
+		}
+
+		reqLogger.Info("Token file changed, swapping vault token", "path", path)
+		f.token = token
+		for _, vclient := range f.clients {
+			vclient.SetToken(token)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+// writeTokenFile writes a token to a file, failing the test on error
+func writeTokenFile(t *testing.T, path, token string) {
+	if err := ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		t.Fatalf("WriteFile() err=%v", err)
+	}
+}
+
+// watchedClients returns the number of clients registered for a token file
+func watchedClients(path string) int {
+	tokenFilesMutex.Lock()
+	defer tokenFilesMutex.Unlock()
+
+	f, found := tokenFiles[path]
+	if !found {
+		return 0
+	}
+	return len(f.clients)
+}
+
+func TestTokenFileProvider(t *testing.T) {
+	stub := newTokenStub(t, 0, false)
+	defer stub.Close()
+
+	dir, err := ioutil.TempDir("", "tokenfile")
+	if err != nil {
+		t.Fatalf("TempDir() err=%v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "token")
+	writeTokenFile(t, path, "token-1")
+
+	// Same server and namespace, only the consistency mode differs
+	bestEffort := stub.config()
+	forwardActive := stub.config()
+	forwardActive.Consistency = ConsistencyForwardActive
+
+	m := NewTokenManager()
+	p := NewTokenFileProvider(path)
+	c1, err := m.Client("ns/cr1", bestEffort, p)
+	if err != nil {
+		t.Fatalf("Client() err=%v", err)
+	}
+	c2, err := m.Client("ns/cr2", forwardActive, p)
+	if err != nil {
+		t.Fatalf("Client() err=%v", err)
+	}
+	if c1 == c2 {
+		t.Fatalf("Client() returned the same client for different consistency modes")
+	}
+	if got := watchedClients(path); got != 2 {
+		t.Errorf("watched clients=%d, want 2", got)
+	}
+
+	writeTokenFile(t, path, "token-2")
+	reloadTokenFiles(dir)
+	for i, vclient := range []*vapi.Client{c1, c2} {
+		if got := vclient.Token(); got != "token-2" {
+			t.Errorf("client %d token=%s, want token-2", i+1, got)
+		}
+	}
+
+	m.Release("ns/cr1")
+	if got := watchedClients(path); got != 1 {
+		t.Errorf("watched clients=%d after release, want 1", got)
+	}
+	m.Release("ns/cr2")
+	if got := watchedClients(path); got != 0 {
+		t.Errorf("watched clients=%d after releasing all the owners, want 0", got)
+	}
+
+	// A released client is not updated anymore
+	writeTokenFile(t, path, "token-3")
+	reloadTokenFiles(dir)
+	if got := c1.Token(); got != "token-2" {
+		t.Errorf("released client token=%s, want token-2", got)
+	}
+	if len(stub.received(routeRevokeSelf)) != 0 {
+		t.Errorf("token read from a file has been revoked")
+	}
+}
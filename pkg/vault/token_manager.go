@@ -0,0 +1,434 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+const (
+	// TokenRenewThreshold is the fraction of a token's TTL after which the token is renewed
+	TokenRenewThreshold = 2.0 / 3.0
+	// TokenMinTTL is the TTL under which a token is not used anymore and a new login is needed
+	TokenMinTTL = 10 * time.Second
+)
+
+// TokenManager keeps the tokens obtained by auth providers to reuse them across reconciles.
+// Tokens are renewed in the background before their TTL runs out and dropped when they cannot
+// be renewed anymore (e.g. max TTL reached), a new login is then done on next use.
+// Each token is used by one or several owners (e.g. custom resources), a token minted by the operator
+// is revoked when it is not used by any owner anymore, unless leases created with it are still in use.
+// It is safe for concurrent use.
+type TokenManager struct {
+	mutex  sync.Mutex
+	tokens map[string]*managedToken
+	// owners maps an owner to the key of the token it uses
+	owners map[string]string
+	// leases keeps the leases created with the tokens, nil if none
+	leases *LeaseManager
+}
+
+// managedToken is a vault client logged in with a token managed by a TokenManager
+type managedToken struct {
+	// mutex prevents concurrent logins for the same key
+	mutex      sync.Mutex
+	client     *vapi.Client
+	ttl        time.Duration
+	expiration time.Time
+	renewable  bool
+	// revocable is true if the token has been minted by the operator
+	revocable bool
+	// method is the name of the auth method used to login
+	method string
+	stop   chan struct{}
+}
+
+// NewTokenManager creates a pointer to a TokenManager struct
+func NewTokenManager() *TokenManager {
+	return &TokenManager{
+		tokens: make(map[string]*managedToken),
+		owners: make(map[string]string),
+	}
+}
+
+// SetLeaseManager sets the lease manager reading dynamic credentials with the tokens
+// Tokens having created leases still in use are not revoked as vault would revoke the leases along with them,
+// they expire at the end of their TTL.
+func (m *TokenManager) SetLeaseManager(leases *LeaseManager) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.leases = leases
+}
+
+// tokenKey returns the key of a token based on the vault server and the identity of the provider
+func tokenKey(c *Config, p AuthProvider) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%t|%x|%s|%x|%s|%s",
+		c.Address, c.Namespace, c.Insecure, sha256.Sum256(c.CACert), c.TLSServerName, sha256.Sum256(c.ClientCert), c.Consistency, p.Identity())))
+	return hex.EncodeToString(hash[:])
+}
+
+// mintsToken checks whether the provider gets a new token from vault when logging in
+// Tokens given as is to the operator are not revoked as they are not owned by the operator
+func mintsToken(p AuthProvider) bool {
+	switch provider := p.(type) {
+	case *TokenProvider, TokenProvider, *TokenFileProvider, TokenFileProvider:
+		return false
+	case *ChainProvider:
+		return provider.succeeded == nil || mintsToken(provider.succeeded)
+	}
+	return true
+}
+
+// reloadsToken checks whether the provider updates the token of its clients by itself
+// Such tokens are renewed by someone else (e.g. Vault Agent) and are kept until vault denies access
+func reloadsToken(p AuthProvider) bool {
+	switch provider := p.(type) {
+	case *TokenFileProvider, TokenFileProvider:
+		return true
+	case *ChainProvider:
+		return provider.succeeded != nil && reloadsToken(provider.succeeded)
+	}
+	return false
+}
+
+// Client returns a vault client logged in using the given provider, reusing a previous login if still valid.
+// If the owner was using another token (e.g. its auth configuration changed), this token is released.
+// The returned client is shared, it must not be modified (use Clone if needed).
+func (m *TokenManager) Client(owner string, c *Config, p AuthProvider) (*vapi.Client, error) {
+	reqLogger := log.WithValues("func", "TokenManager.Client")
+	key := tokenKey(c, p)
+	retainUnwrappedSecretIDs(owner, p)
+
+	m.mutex.Lock()
+	var released *managedToken
+	if previousKey, found := m.owners[owner]; found && previousKey != key {
+		released = m.releaseLocked(owner)
+	}
+	m.owners[owner] = key
+	t, found := m.tokens[key]
+	if !found {
+		t = &managedToken{}
+		m.tokens[key] = t
+	}
+	m.mutex.Unlock()
+
+	if released != nil {
+		// Revoked in the background as the previous vault server may not be reachable anymore (failover)
+		reqLogger.Info("Auth configuration or vault server changed, releasing previous vault token")
+		go m.revoke(released)
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.valid() {
+		reqLogger.Info("Reusing existing vault token")
+		return t.client, nil
+	}
+
+	// Login again, the previous token (if any) is not usable anymore
+	if previous := t.drop(); previous != nil {
+		go m.revokeClient(previous)
+	}
+	vclient, err := p.Login(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.setClient(vclient); err != nil {
+		if mintsToken(p) {
+			go revokeClient(vclient)
+		}
+		return nil, err
+	}
+	t.revocable = mintsToken(p)
+	t.method = AuthMethodName(p)
+	if reloadsToken(p) {
+		t.renewable = false
+		t.expiration = time.Time{}
+	}
+
+	if t.renewable && t.ttl > 0 {
+		go m.renew(key, t, t.stop)
+	}
+
+	return t.client, nil
+}
+
+// Invalidate checks the token associated with the given provider when vault denies access and drops it if it is
+// not valid anymore (e.g. revoked), a new login is then done on next use. It returns whether the token has been dropped.
+// A valid token is kept: access is denied by a policy and a new login would not change anything.
+// The token is not revoked, it may be shared by other owners and cannot be used anyway.
+func (m *TokenManager) Invalidate(c *Config, p AuthProvider) bool {
+	m.mutex.Lock()
+	t, found := m.tokens[tokenKey(c, p)]
+	m.mutex.Unlock()
+	if !found {
+		return true
+	}
+
+	t.mutex.Lock()
+	vclient := t.client
+	t.mutex.Unlock()
+	if vclient == nil {
+		return true
+	}
+
+	if _, err := vclient.Auth().Token().LookupSelf(); !IsPermissionDenied(err) {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// Another owner may have logged in again in the meantime
+	if t.client == vclient {
+		t.stopRenewal()
+	}
+	return true
+}
+
+// AuthMethod returns the name of the auth method used to get the token associated with the given provider
+// Empty if no token is managed for this provider
+func (m *TokenManager) AuthMethod(c *Config, p AuthProvider) string {
+	m.mutex.Lock()
+	t, found := m.tokens[tokenKey(c, p)]
+	m.mutex.Unlock()
+	if !found {
+		return ""
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.method
+}
+
+// Release releases the token used by the owner (e.g. when a custom resource is deleted)
+// The token is revoked if it is not used by any other owner, as well as the secret IDs unwrapped for the owner only
+func (m *TokenManager) Release(owner string) {
+	releaseUnwrappedSecretIDs(owner)
+
+	m.mutex.Lock()
+	released := m.releaseLocked(owner)
+	m.mutex.Unlock()
+
+	if released != nil {
+		m.revoke(released)
+	}
+}
+
+// RevokeAll revokes all the tokens minted by the operator, used on shutdown
+func (m *TokenManager) RevokeAll() {
+	m.mutex.Lock()
+	tokens := m.tokens
+	m.tokens = make(map[string]*managedToken)
+	m.owners = make(map[string]string)
+	m.mutex.Unlock()
+
+	for _, t := range tokens {
+		m.revoke(t)
+	}
+}
+
+// releaseLocked removes the owner and returns its token if no other owner uses it, m.mutex must be held
+func (m *TokenManager) releaseLocked(owner string) *managedToken {
+	key, found := m.owners[owner]
+	if !found {
+		return nil
+	}
+	delete(m.owners, owner)
+
+	for _, k := range m.owners {
+		if k == key {
+			return nil
+		}
+	}
+
+	t := m.tokens[key]
+	delete(m.tokens, key)
+	return t
+}
+
+// remove removes a token from the manager, stops its renewal and revokes it in the background
+// If t is not nil, the token is only removed if the key still refers to it
+func (m *TokenManager) remove(key string, t *managedToken) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	current, found := m.tokens[key]
+	if !found || (t != nil && current != t) {
+		return
+	}
+
+	current.mutex.Lock()
+	if vclient := current.drop(); vclient != nil {
+		go m.revokeClient(vclient)
+	}
+	current.mutex.Unlock()
+	delete(m.tokens, key)
+}
+
+// renew renews a token in the background until it cannot be renewed anymore or stop is closed
+func (m *TokenManager) renew(key string, t *managedToken, stop chan struct{}) {
+	reqLogger := log.WithValues("func", "TokenManager.renew")
+
+	for {
+		t.mutex.Lock()
+		wait := time.Duration(float64(t.ttl) * TokenRenewThreshold)
+		vclient := t.client
+		t.mutex.Unlock()
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+
+		reqLogger.Info("Renewing vault token")
+		s, err := vclient.Auth().Token().RenewSelf(0)
+		if err != nil {
+			reqLogger.Error(err, "Unable to renew vault token, a new login will be done on next use")
+			m.remove(key, t)
+			return
+		}
+
+		ttl, err := s.TokenTTL()
+		if err != nil {
+			reqLogger.Error(err, "Unable to get renewed vault token TTL, a new login will be done on next use")
+			m.remove(key, t)
+			return
+		}
+
+		t.mutex.Lock()
+		select {
+		case <-stop:
+			// Stopped while renewing, the token is not managed anymore
+			t.mutex.Unlock()
+			return
+		default:
+		}
+		capped := ttl < t.ttl
+		t.ttl = ttl
+		t.expiration = time.Now().Add(ttl)
+		t.mutex.Unlock()
+
+		if capped {
+			// Max TTL has been reached, the token is used until it expires and a new login is done on next use
+			reqLogger.Info("Vault token reached its max TTL, not renewing it anymore")
+			return
+		}
+	}
+}
+
+// setClient sets the client of a managed token, looking up its TTL
+func (t *managedToken) setClient(vclient *vapi.Client) error {
+	s, err := vclient.Auth().Token().LookupSelf()
+	if err != nil {
+		return fmt.Errorf("Unable to lookup vault token, err=%v", err)
+	}
+
+	ttl, err := s.TokenTTL()
+	if err != nil {
+		return err
+	}
+	renewable, err := s.TokenIsRenewable()
+	if err != nil {
+		return err
+	}
+
+	t.client = vclient
+	t.ttl = ttl
+	t.renewable = renewable
+	t.expiration = time.Time{}
+	if ttl > 0 {
+		t.expiration = time.Now().Add(ttl)
+	}
+	t.stop = make(chan struct{})
+
+	return nil
+}
+
+// revoke revokes a token if it has been minted by the operator and stops its renewal
+func (m *TokenManager) revoke(t *managedToken) {
+	t.mutex.Lock()
+	vclient := t.drop()
+	t.mutex.Unlock()
+
+	if vclient != nil {
+		m.revokeClient(vclient)
+	}
+}
+
+// revokeClient revokes the token of a client unless leases created with it are still in use
+func (m *TokenManager) revokeClient(vclient *vapi.Client) {
+	m.mutex.Lock()
+	leases := m.leases
+	m.mutex.Unlock()
+
+	if leases != nil && leases.HasLeases(vclient.Token()) {
+		log.Info("Not revoking vault token as leases created with it are still in use, it expires at the end of its TTL")
+		return
+	}
+	revokeClient(vclient)
+}
+
+// drop stops the renewal of the token and returns its client if the token has been minted by the operator
+// and has to be revoked, t.mutex must be held
+func (t *managedToken) drop() *vapi.Client {
+	vclient := t.client
+	t.stopRenewal()
+	if vclient == nil || !t.revocable {
+		return nil
+	}
+	return vclient
+}
+
+// revokeClient revokes the token of a client
+func revokeClient(vclient *vapi.Client) {
+	log.Info("Revoking vault token")
+	if err := vclient.Auth().Token().RevokeSelf(""); err != nil {
+		log.Error(err, "Unable to revoke vault token")
+	}
+}
+
+// valid checks whether the token can still be used, t.mutex must be held
+func (t *managedToken) valid() bool {
+	if t.client == nil {
+		return false
+	}
+
+	// A zero expiration means that the token never expires
+	return t.expiration.IsZero() || time.Until(t.expiration) > TokenMinTTL
+}
+
+// stopRenewal stops the background renewal of the token and the reload of its token file if any, t.mutex must be held
+func (t *managedToken) stopRenewal() {
+	if t.stop != nil {
+		close(t.stop)
+		t.stop = nil
+	}
+	if t.client != nil {
+		unwatchTokenFile(t.client)
+	}
+	t.client = nil
+}
@@ -0,0 +1,319 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	routeAppRoleLogin = "PUT /v1/auth/approle/login"
+	routeLookupSelf   = "GET /v1/auth/token/lookup-self"
+	routeRenewSelf    = "PUT /v1/auth/token/renew-self"
+	routeRevokeSelf   = "PUT /v1/auth/token/revoke-self"
+)
+
+// newTokenStub starts a vault stub minting tokens (token-1, token-2, etc.) with the given TTL on AppRole logins
+func newTokenStub(t *testing.T, ttl int, renewable bool) *vaultStub {
+	var logins int64
+	return newVaultStub(t, map[string]http.HandlerFunc{
+		routeAppRoleLogin: func(w http.ResponseWriter, req *http.Request) {
+			token := fmt.Sprintf("token-%d", atomic.AddInt64(&logins, 1))
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"auth": map[string]interface{}{"client_token": token, "lease_duration": ttl, "renewable": renewable},
+			})
+		},
+		routeLookupSelf: respond(http.StatusOK, map[string]interface{}{
+			"data": map[string]interface{}{"ttl": ttl, "renewable": renewable},
+		}),
+		routeRenewSelf: respond(http.StatusOK, map[string]interface{}{
+			"auth": map[string]interface{}{"lease_duration": ttl, "renewable": renewable},
+		}),
+		routeRevokeSelf: respond(http.StatusNoContent, nil),
+	})
+}
+
+func TestTokenManagerClient(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        int
+		renewable  bool
+		wantLogins int
+	}{
+		{name: "valid token is reused", ttl: 3600, wantLogins: 1},
+		{name: "token which never expires is reused", ttl: 0, wantLogins: 1},
+		{name: "token about to expire is not reused", ttl: int(TokenMinTTL.Seconds()) - 1, wantLogins: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTokenStub(t, tt.ttl, tt.renewable)
+			defer stub.Close()
+
+			m := NewTokenManager()
+			c := stub.config()
+			p := NewAppRoleProvider("approle", "role-id", "secret-id")
+			for i := 0; i < 2; i++ {
+				vclient, err := m.Client("ns/cr", c, p)
+				if err != nil {
+					t.Fatalf("Client() err=%v", err)
+				}
+				if vclient.Token() == "" {
+					t.Fatalf("Client() returned a client without token")
+				}
+			}
+
+			if got := len(stub.received(routeAppRoleLogin)); got != tt.wantLogins {
+				t.Errorf("logins=%d, want %d", got, tt.wantLogins)
+			}
+		})
+	}
+}
+
+func TestTokenManagerJWTSource(t *testing.T) {
+	stub := newTokenStub(t, 3600, false)
+	defer stub.Close()
+	stub.handlers["PUT /v1/auth/kubernetes/login"] = stub.handlers[routeAppRoleLogin]
+
+	m := NewTokenManager()
+	c := stub.config()
+	sourced := 0
+	for i := 0; i < 2; i++ {
+		// A new provider is created on each reconcile
+		p := NewKubernetesProvider("app", "kubernetes", "")
+		p.SetJWTSource("system:serviceaccount:ns:default", func() (string, error) {
+			sourced++
+			return "sa-token", nil
+		})
+		if _, err := m.Client("ns/cr", c, p); err != nil {
+			t.Fatalf("Client() err=%v", err)
+		}
+	}
+
+	if sourced != 1 {
+		t.Errorf("jwt tokens sourced=%d, want 1", sourced)
+	}
+	if got := len(stub.received("PUT /v1/auth/kubernetes/login")); got != 1 {
+		t.Errorf("logins=%d, want 1", got)
+	}
+}
+
+func TestTokenManagerRenew(t *testing.T) {
+	stub := newTokenStub(t, 1, true)
+	defer stub.Close()
+
+	m := NewTokenManager()
+	c := stub.config()
+	p := NewAppRoleProvider("approle", "role-id", "secret-id")
+	if _, err := m.Client("ns/cr", c, p); err != nil {
+		t.Fatalf("Client() err=%v", err)
+	}
+
+	// The token is renewed once 2/3 of its TTL has passed
+	deadline := time.Now().Add(5 * time.Second)
+	for len(stub.received(routeRenewSelf)) == 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if len(stub.received(routeRenewSelf)) == 0 {
+		t.Fatalf("Token has not been renewed")
+	}
+	m.Release("ns/cr")
+}
+
+func TestTokenManagerInvalidate(t *testing.T) {
+	tests := []struct {
+		name         string
+		lookupStatus int
+		want         bool
+		wantLogins   int
+	}{
+		{name: "valid token kept", lookupStatus: http.StatusOK, want: false, wantLogins: 1},
+		{name: "invalid token dropped", lookupStatus: http.StatusForbidden, want: true, wantLogins: 2},
+		{name: "token kept if vault is not available", lookupStatus: http.StatusServiceUnavailable, want: false, wantLogins: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTokenStub(t, 3600, false)
+			defer stub.Close()
+
+			m := NewTokenManager()
+			c := stub.config()
+			p := NewAppRoleProvider("approle", "role-id", "secret-id")
+			// The token is shared by two owners
+			first, err := m.Client("ns/a", c, p)
+			if err != nil {
+				t.Fatalf("Client() err=%v", err)
+			}
+			if _, err := m.Client("ns/b", c, p); err != nil {
+				t.Fatalf("Client() err=%v", err)
+			}
+
+			stub.mutex.Lock()
+			stub.handlers[routeLookupSelf] = respond(tt.lookupStatus, map[string]interface{}{
+				"data": map[string]interface{}{"ttl": 3600}, "errors": []string{},
+			})
+			stub.mutex.Unlock()
+			if got := m.Invalidate(c, p); got != tt.want {
+				t.Errorf("Invalidate()=%t, want %t", got, tt.want)
+			}
+			stub.mutex.Lock()
+			stub.handlers[routeLookupSelf] = respond(http.StatusOK, map[string]interface{}{"data": map[string]interface{}{"ttl": 3600}})
+			stub.mutex.Unlock()
+
+			for _, owner := range []string{"ns/a", "ns/b"} {
+				vclient, err := m.Client(owner, c, p)
+				if err != nil {
+					t.Fatalf("Client() err=%v", err)
+				}
+				if reused := vclient.Token() == first.Token(); reused == tt.want {
+					t.Errorf("%s: token reused=%t, want %t", owner, reused, !tt.want)
+				}
+			}
+			if got := len(stub.received(routeAppRoleLogin)); got != tt.wantLogins {
+				t.Errorf("logins=%d, want %d", got, tt.wantLogins)
+			}
+			// Tokens are never revoked when invalidated, they are shared or not usable anyway
+			if got := len(stub.received(routeRevokeSelf)); got != 0 {
+				t.Errorf("revocations=%d, want 0", got)
+			}
+		})
+	}
+}
+
+func TestTokenManagerRelease(t *testing.T) {
+	tests := []struct {
+		name        string
+		provider    AuthProvider
+		owners      []string
+		released    []string
+		wantRevoked int
+	}{
+		{name: "token used by another owner is kept", provider: NewAppRoleProvider("approle", "role-id", "secret-id"),
+			owners: []string{"ns/a", "ns/b"}, released: []string{"ns/a"}, wantRevoked: 0},
+		{name: "token not used anymore is revoked", provider: NewAppRoleProvider("approle", "role-id", "secret-id"),
+			owners: []string{"ns/a", "ns/b"}, released: []string{"ns/a", "ns/b"}, wantRevoked: 1},
+		{name: "token not minted by the operator is not revoked", provider: NewTokenProvider("given-token"),
+			owners: []string{"ns/a"}, released: []string{"ns/a"}, wantRevoked: 0},
+		{name: "unknown owner", provider: NewAppRoleProvider("approle", "role-id", "secret-id"),
+			owners: []string{"ns/a"}, released: []string{"ns/b"}, wantRevoked: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTokenStub(t, 3600, false)
+			defer stub.Close()
+
+			m := NewTokenManager()
+			c := stub.config()
+			for _, owner := range tt.owners {
+				if _, err := m.Client(owner, c, tt.provider); err != nil {
+					t.Fatalf("Client() err=%v", err)
+				}
+			}
+			for _, owner := range tt.released {
+				m.Release(owner)
+			}
+
+			if got := len(stub.received(routeRevokeSelf)); got != tt.wantRevoked {
+				t.Errorf("revocations=%d, want %d", got, tt.wantRevoked)
+			}
+		})
+	}
+}
+
+func TestTokenManagerRevokeDropped(t *testing.T) {
+	tests := []struct {
+		name string
+		drop func(m *TokenManager, c *Config, p AuthProvider)
+	}{
+		{name: "auth configuration changed", drop: func(m *TokenManager, c *Config, p AuthProvider) {
+			m.Client("ns/cr", c, NewAppRoleProvider("approle", "other-role-id", "secret-id"))
+		}},
+		{name: "shutdown", drop: func(m *TokenManager, c *Config, p AuthProvider) {
+			m.RevokeAll()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub := newTokenStub(t, 3600, false)
+			defer stub.Close()
+
+			m := NewTokenManager()
+			c := stub.config()
+			p := NewAppRoleProvider("approle", "role-id", "secret-id")
+			vclient, err := m.Client("ns/cr", c, p)
+			if err != nil {
+				t.Fatalf("Client() err=%v", err)
+			}
+			token := vclient.Token()
+
+			tt.drop(m, c, p)
+
+			// Some tokens are revoked in the background
+			deadline := time.Now().Add(5 * time.Second)
+			for len(stub.received(routeRevokeSelf)) == 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			revoked := stub.received(routeRevokeSelf)
+			if len(revoked) != 1 || revoked[0].token != token {
+				t.Errorf("revocations=%v, want %s revoked", revoked, token)
+			}
+		})
+	}
+}
+
+func TestTokenManagerFailover(t *testing.T) {
+	previous := newTokenStub(t, 3600, false)
+	defer previous.Close()
+	release := make(chan struct{})
+	defer close(release)
+	// The previous server does not answer anymore
+	previous.handlers[routeRevokeSelf] = func(w http.ResponseWriter, req *http.Request) {
+		<-release
+	}
+	next := newTokenStub(t, 3600, false)
+	defer next.Close()
+
+	m := NewTokenManager()
+	p := NewAppRoleProvider("approle", "role-id", "secret-id")
+	if _, err := m.Client("ns/cr", previous.config(), p); err != nil {
+		t.Fatalf("Client() err=%v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := m.Client("ns/cr", next.config(), p)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Client() err=%v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Client() waits for the revocation of the previous token")
+	}
+	if got := len(next.received(routeAppRoleLogin)); got != 1 {
+		t.Errorf("logins=%d on the new server, want 1", got)
+	}
+}
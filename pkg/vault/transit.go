@@ -0,0 +1,65 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"encoding/base64"
+	"fmt"
+	"path"
+	"strings"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+// TransitCiphertextPrefix is the prefix of the ciphertexts produced by a transit secrets engine
+const TransitCiphertextPrefix = "vault:v"
+
+// Decrypt decrypts a ciphertext (vault:v1:...) using a transit secrets engine's key
+// context is the base64 encoded context of derived keys, optional
+func Decrypt(client *vapi.Client, mount, key, ciphertext, context string) ([]byte, error) {
+	ciphertext = strings.TrimSpace(ciphertext)
+	if !strings.HasPrefix(ciphertext, TransitCiphertextPrefix) {
+		return nil, fmt.Errorf("Invalid ciphertext, it must start with %s", TransitCiphertextPrefix)
+	}
+
+	data := map[string]interface{}{
+		"ciphertext": ciphertext,
+	}
+	if context != "" {
+		data["context"] = context
+	}
+
+	decryptPath := path.Join(mount, "decrypt", key)
+	secret, err := client.Logical().Write(decryptPath, data)
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil || secret.Data == nil {
+		return nil, &PathNotFound{decryptPath}
+	}
+
+	plaintext, ok := secret.Data["plaintext"].(string)
+	if !ok {
+		return nil, fmt.Errorf("No plaintext returned by vault for %s", decryptPath)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode plaintext, err=%v", err)
+	}
+
+	return decoded, nil
+}
@@ -0,0 +1,96 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const routeDecrypt = "PUT /v1/transit/decrypt/app"
+
+func TestDecrypt(t *testing.T) {
+	tests := []struct {
+		name          string
+		ciphertext    string
+		context       string
+		status        int
+		response      map[string]interface{}
+		wantErr       bool
+		wantRequest   bool
+		wantPlaintext string
+	}{
+		{name: "decrypted", ciphertext: "vault:v1:abcd", status: http.StatusOK,
+			response:    map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString([]byte("s3cr3t"))},
+			wantRequest: true, wantPlaintext: "s3cr3t"},
+		{name: "whitespaces trimmed", ciphertext: "  vault:v1:abcd\n", status: http.StatusOK,
+			response:    map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString([]byte("s3cr3t"))},
+			wantRequest: true, wantPlaintext: "s3cr3t"},
+		{name: "derived key context", ciphertext: "vault:v2:abcd", context: "Y29udGV4dA==", status: http.StatusOK,
+			response:    map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString([]byte("s3cr3t"))},
+			wantRequest: true, wantPlaintext: "s3cr3t"},
+		{name: "empty plaintext", ciphertext: "vault:v1:abcd", status: http.StatusOK,
+			response:    map[string]interface{}{"plaintext": ""},
+			wantRequest: true, wantPlaintext: ""},
+		{name: "invalid prefix", ciphertext: "abcd", wantErr: true},
+		{name: "no plaintext returned", ciphertext: "vault:v1:abcd", status: http.StatusOK,
+			response: map[string]interface{}{}, wantRequest: true, wantErr: true},
+		{name: "plaintext not base64 encoded", ciphertext: "vault:v1:abcd", status: http.StatusOK,
+			response: map[string]interface{}{"plaintext": "s3cr3t!"}, wantRequest: true, wantErr: true},
+		{name: "decryption error", ciphertext: "vault:v1:abcd", status: http.StatusBadRequest,
+			response: map[string]interface{}{"errors": []string{"invalid ciphertext"}}, wantRequest: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := map[string]interface{}{"data": tt.response}
+			if tt.status != http.StatusOK {
+				body = tt.response
+			}
+			stub := newVaultStub(t, map[string]http.HandlerFunc{routeDecrypt: respond(tt.status, body)})
+			defer stub.Close()
+			vclient, err := stub.config().newClient()
+			if err != nil {
+				t.Fatalf("newClient() err=%v", err)
+			}
+
+			plaintext, err := Decrypt(vclient, "transit", "app", tt.ciphertext, tt.context)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Decrypt() err=%v, wantErr %t", err, tt.wantErr)
+			}
+			if string(plaintext) != tt.wantPlaintext {
+				t.Errorf("Decrypt()=%q, want %q", plaintext, tt.wantPlaintext)
+			}
+
+			requests := stub.received(routeDecrypt)
+			if (len(requests) == 1) != tt.wantRequest {
+				t.Fatalf("requests=%d, want request %t", len(requests), tt.wantRequest)
+			}
+			if !tt.wantRequest {
+				return
+			}
+			if got := requests[0].body["ciphertext"]; got != strings.TrimSpace(tt.ciphertext) {
+				t.Errorf("ciphertext=%q, want %q", got, strings.TrimSpace(tt.ciphertext))
+			}
+			if context, _ := requests[0].body["context"].(string); context != tt.context {
+				t.Errorf("context=%q, want %q", context, tt.context)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vault
+
+import (
+	"fmt"
+
+	vapi "github.com/hashicorp/vault/api"
+)
+
+var _ AuthProvider = (*UserPassProvider)(nil)
+
+// UserPassProvider is a provider to authenticate using the Vault Userpass Auth Method
+// https://www.vaultproject.io/docs/auth/userpass
+type UserPassProvider struct {
+	// Path is the mount path of the auth method used to call the login URL
+	Path     string
+	Username string
+	password string
+}
+
+// NewUserPassProvider creates a pointer to a UserPassProvider struct
+func NewUserPassProvider(path, username, password string) *UserPassProvider {
+	return &UserPassProvider{
+		Path:     path,
+		Username: username,
+		password: password,
+	}
+}
+
+// Identity returns the credentials the provider logs in with
+func (p UserPassProvider) Identity() string {
+	return fmt.Sprintf("userpass:%s:%s:%s", p.Path, p.Username, p.password)
+}
+
+// Login authenticates to the configured vault server
+func (p UserPassProvider) Login(c *Config) (*vapi.Client, error) {
+	log.Info("Authenticating using userpass auth method")
+	vclient, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string]interface{}{
+		"password": p.password,
+	}
+	s, err := vclient.Logical().Write(fmt.Sprintf("auth/%s/login/%s", p.Path, p.Username), data)
+	if err != nil {
+		return nil, err
+	}
+
+	vclient.SetToken(s.Auth.ClientToken)
+	return vclient, nil
+}